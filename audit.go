@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+)
+
+// auditedApp is an app along with the stack it runs on, empty for Docker apps.
+type auditedApp struct {
+	Name  string
+	Space string
+	Stack string
+}
+
+// GetAppStacks returns the apps of the space, or of every space of the org
+// when spaceGuid is empty, along with their stacks.
+func (repo *ApplicationRepo) GetAppStacks(orgGuid, spaceGuid string) ([]auditedApp, error) {
+	path := fmt.Sprintf("/v3/apps?organization_guids=%s&include=space&order_by=name&per_page=5000", url.QueryEscape(orgGuid))
+	if spaceGuid != "" {
+		path = fmt.Sprintf("/v3/apps?space_guids=%s&include=space&order_by=name&per_page=5000", url.QueryEscape(spaceGuid))
+	}
+	var apps []auditedApp
+	err := repo.curlPages(path, func(body []byte) error {
+		// The spaces are included with the page of their apps.
+		var page struct {
+			Resources []struct {
+				Name          string    `json:"name"`
+				Lifecycle     Lifecycle `json:"lifecycle"`
+				Relationships struct {
+					Space struct {
+						Data struct {
+							GUID string `json:"guid"`
+						} `json:"data"`
+					} `json:"space"`
+				} `json:"relationships"`
+			} `json:"resources"`
+			Included struct {
+				Spaces []struct {
+					GUID string `json:"guid"`
+					Name string `json:"name"`
+				} `json:"spaces"`
+			} `json:"included"`
+		}
+		err := json.Unmarshal(body, &page)
+		if err != nil {
+			return err
+		}
+		spaceNames := map[string]string{}
+		for _, space := range page.Included.Spaces {
+			spaceNames[space.GUID] = space.Name
+		}
+		for _, app := range page.Resources {
+			apps = append(apps, auditedApp{
+				Name:  app.Name,
+				Space: spaceNames[app.Relationships.Space.Data.GUID],
+				Stack: app.Lifecycle.Data.Stack,
+			})
+		}
+		return nil
+	})
+	return apps, err
+}
+
+// printAudit prints the stack of each app and whether it is on the target
+// stack, followed by the number of apps left to migrate.
+func printAudit(apps []auditedApp, targetStack string, allSpaces bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if allSpaces {
+		fmt.Fprint(w, "space\t")
+	}
+	fmt.Fprintln(w, "app\tstack\tstatus")
+	pending := 0
+	for _, app := range apps {
+		stack, status := app.Stack, "migrated"
+		switch {
+		case stack == "":
+			stack, status = "-", "docker, no stack"
+		case stack != targetStack:
+			status = "to migrate"
+			pending++
+		}
+		if allSpaces {
+			fmt.Fprintf(w, "%s\t", app.Space)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", app.Name, stack, status)
+	}
+	w.Flush()
+	fmt.Println()
+	fmt.Printf("%d of %d apps still to migrate to %s\n", pending, len(apps), targetStack)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/cli/plugin"
+)
+
+// errSkipped is the error of the apps not migrated because of --fail-fast.
+var errSkipped = errors.New("skipped after an earlier failure")
+
+type changeStackResult struct {
+	AppName string
+	Err     error
+}
+
+// changeStackOfApps changes the stack of each app in turn. Every app gets its
+// own temp dir and rewind actions, so a failure only rolls back the app it
+// occurred on and the remaining apps are still migrated. With
+// options.AppTimeout, an app taking too long is rolled back so the next one
+// can be migrated. With options.FailFast, the apps after the first one which
+// failed are skipped.
+func changeStackOfApps(ctx context.Context, cliConnection plugin.CliConnection, appNames []string, newStackName string, options changeStackOptions) []changeStackResult {
+	if options.Parallel > 1 {
+		return changeStackOfAppsInParallel(ctx, cliConnection, appNames, newStackName, options)
+	}
+	results := make([]changeStackResult, 0, len(appNames))
+	text := options.Output != jsonOutput
+	for _, appName := range appNames {
+		if ctx.Err() != nil {
+			results = append(results, changeStackResult{AppName: appName, Err: fmt.Errorf("not attempted: %s", ctx.Err())})
+			continue
+		}
+		if text {
+			fmt.Printf("\nchanging stack of app %s to %s\n", appName, newStackName)
+		}
+		err := changeStackWithTimeout(ctx, cliConnection, appName, newStackName, options, os.Stdout)
+		if err != nil && !isAlreadyOnStack(err) {
+			logf(logError, appName, "error: %s", err)
+		}
+		if isAlreadyOnStack(err) {
+			if text {
+				fmt.Println(err)
+			}
+			err = nil
+		}
+		if err != nil && text {
+			printError(err)
+		}
+		results = append(results, changeStackResult{AppName: appName, Err: err})
+		if err != nil && options.FailFast {
+			for _, skipped := range appNames[len(results):] {
+				results = append(results, changeStackResult{AppName: skipped, Err: errSkipped})
+			}
+			break
+		}
+	}
+	return results
+}
+
+// changeStackOfAppsInParallel changes the stack of options.Parallel apps at a
+// time, like changeStackOfApps otherwise. The steps of the stack changes are
+// printed as they complete on lines prefixed with the name of their app, and
+// the rest of the output of each stack change, such as warnings, is kept
+// apart and printed the same way once it is over, so the lines of concurrent
+// stack changes can't be interleaved. With the json output, the rest of the
+// output goes to stderr.
+func changeStackOfAppsInParallel(ctx context.Context, cliConnection plugin.CliConnection, appNames []string, newStackName string, options changeStackOptions) []changeStackResult {
+	results := make([]changeStackResult, len(appNames))
+	indexes := make(chan int)
+	var failed int32
+	var wg sync.WaitGroup
+
+	// os.Stdout isn't modified while the workers run, reading it is safe.
+	var out io.Writer = os.Stdout
+	if options.Output == jsonOutput {
+		out = os.Stderr
+	}
+	for worker := 0; worker < options.Parallel; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A panic here wouldn't go through the cleanups deferred by Run.
+			defer func() {
+				if r := recover(); r != nil {
+					runCleanups()
+					panic(r)
+				}
+			}()
+			for i := range indexes {
+				appName := appNames[i]
+				switch {
+				case ctx.Err() != nil:
+					results[i] = changeStackResult{AppName: appName, Err: fmt.Errorf("not attempted: %s", ctx.Err())}
+					continue
+				case options.FailFast && atomic.LoadInt32(&failed) > 0:
+					results[i] = changeStackResult{AppName: appName, Err: errSkipped}
+					continue
+				}
+				if options.Output != jsonOutput {
+					printPrefixed(progressEvent{App: appName, Status: "started", Message: "changing stack to " + newStackName})
+				}
+				var output bytes.Buffer
+				err := changeStackWithTimeout(ctx, cliConnection, appName, newStackName, options, &output)
+				printPrefixedOutput(out, appName, output.String())
+				if isAlreadyOnStack(err) {
+					err = nil
+				}
+				if err != nil {
+					logf(logError, appName, "error: %s", err)
+					atomic.AddInt32(&failed, 1)
+				}
+				results[i] = changeStackResult{AppName: appName, Err: err}
+			}
+		}()
+	}
+	for i := range appNames {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+func changeStackWithTimeout(ctx context.Context, cliConnection plugin.CliConnection, appName string, newStackName string, options changeStackOptions, out io.Writer) error {
+	if options.AppTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.AppTimeout)
+		defer cancel()
+	}
+	return changeStack(ctx, cliConnection, appName, newStackName, options, out)
+}
+
+func failedCount(results []changeStackResult) int {
+	count := 0
+	for _, result := range results {
+		if result.Err != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// reportResults prints the summary of the stack change of several apps and
+// exits with an error status if any failed, the highest exit code of the
+// failures telling the worst outcome.
+func reportResults(results []changeStackResult, options changeStackOptions) {
+	if options.Output == jsonOutput {
+		emitSummary(results)
+	} else {
+		printSummary(results)
+	}
+	code := 0
+	for _, result := range results {
+		if result.Err != nil && exitCode(result.Err) > code {
+			code = exitCode(result.Err)
+		}
+	}
+	if code != 0 {
+		exit(code)
+	}
+}
+
+func printSummary(results []changeStackResult) {
+	fmt.Println()
+	fmt.Printf("%d of %d apps changed stack with no downtime\n", len(results)-failedCount(results), len(results))
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Printf("  %s: FAILED (%s)\n", result.AppName, result.Err)
+		} else {
+			fmt.Printf("  %s: OK\n", result.AppName)
+		}
+	}
+	fmt.Println()
+}
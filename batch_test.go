@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBatchRollsBackStuckAppAndGoesOn(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("BG_CHANGE_STACK_POLL_INTERVAL", "10ms")
+	cf := newFakeCF("stuck", "healthy")
+	stuckGuid := cf.apps["stuck"]
+	cf.notRunning["stuck"] = true
+	options := testOptions(t, "--no-telemetry", "--quiet", "--app-timeout", "500ms")
+
+	start := time.Now()
+	results := changeStackOfApps(context.Background(), cf, []string{"stuck", "healthy"}, "cflinuxfs4", options)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the batch took %s, the stuck app should have timed out after 500ms", elapsed)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %v", len(results), results)
+	}
+	if results[0].Err == nil {
+		t.Fatal("the stack change of the stuck app succeeded")
+	}
+	if code := exitCode(results[0].Err); code != exitRolledBack {
+		t.Errorf("the stuck app failed with exit code %d, want %d (rolled back): %s", code, exitRolledBack, results[0].Err)
+	}
+	if cf.apps["stuck"] != stuckGuid {
+		t.Errorf("app stuck is %s, want the old app %s", cf.apps["stuck"], stuckGuid)
+	}
+	if _, ok := cf.apps["stuck-venerable"]; ok {
+		t.Error("app stuck-venerable was left behind")
+	}
+	if results[1].Err != nil {
+		t.Errorf("the stack change of the app after the stuck one failed: %s", results[1].Err)
+	}
+}
+
+func TestParallelBatchRunsOneCfCommandAtATime(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("BG_CHANGE_STACK_POLL_INTERVAL", "10ms")
+	cf := newFakeCF("first", "second", "third")
+	cf.callDelay = time.Millisecond
+	options := testOptions(t, "--no-telemetry", "--parallel", "3")
+
+	results := changeStackOfApps(context.Background(), newSerialConnection(cf), []string{"first", "second", "third"}, "cflinuxfs4", options)
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("the stack change of app %s failed: %s", result.AppName, result.Err)
+		}
+	}
+	if atomic.LoadInt32(&cf.overlapped) != 0 {
+		t.Error("cf commands of apps migrated in parallel overlapped")
+	}
+}
@@ -6,4 +6,8 @@ echo -e "\nGenerating Binary..."
 
 CURRENTDIR=`pwd`
 
-go build -o $CURRENTDIR/out/cf-bg-change-stack
+VERSION=${VERSION:-1.1.0}
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+
+go build -ldflags "-X main.version=$VERSION -X main.commit=$COMMIT -X main.buildDate=$BUILD_DATE" -o $CURRENTDIR/out/cf-bg-change-stack
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// BuildpackAvailableOn tells whether the named buildpack can stage apps on
+// the stack. Buildpacks given by URL can't be checked and are assumed to.
+func (repo *ApplicationRepo) BuildpackAvailableOn(name, stackName string) (bool, error) {
+	if strings.Contains(name, "://") {
+		return true, nil
+	}
+	var buildpacks []struct {
+		Stack string `json:"stack"`
+	}
+	err := repo.curlAll(&buildpacks, fmt.Sprintf("/v3/buildpacks?names=%s&per_page=5000", url.QueryEscape(name)))
+	if err != nil {
+		return false, err
+	}
+	for _, buildpack := range buildpacks {
+		// Buildpacks without a stack stage apps on any stack.
+		if buildpack.Stack == "" || buildpack.Stack == stackName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// PinBuildpacks makes the manifest of the app name the buildpacks the app was
+// staged with, so the new app doesn't detect different ones, and warns about
+// those which aren't available on the new stack.
+func (repo *ApplicationRepo) PinBuildpacks(appName, newStackName string) error {
+	appGuid, err := repo.GetAppGuid(appName)
+	if err != nil {
+		return err
+	}
+	app, err := repo.GetApp(appGuid)
+	if err != nil {
+		return err
+	}
+	buildpacks := app.Lifecycle.Data.Buildpacks
+	if len(buildpacks) == 0 {
+		return nil
+	}
+
+	for _, buildpack := range buildpacks {
+		available, err := repo.BuildpackAvailableOn(buildpack, newStackName)
+		if err != nil {
+			return err
+		}
+		if !available {
+			repo.printf("warning: buildpack %s of app %s is not available on stack %s, staging will likely fail\n", buildpack, appName, newStackName)
+		}
+	}
+	return repo.SetManifestBuildpacks(appName, buildpacks)
+}
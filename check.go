@@ -0,0 +1,61 @@
+package main
+
+import "fmt"
+
+// checkReadiness runs the pre-flight checks which don't depend on the new
+// stack against the app, without modifying anything, and prints a report of
+// their outcomes. It returns the number of checks which failed.
+func checkReadiness(appRepo *ApplicationRepo, appName, venerableSuffix string) (int, error) {
+	exists, err := appRepo.DoesAppExist(appName)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, fmt.Errorf("app '%s' not found in current space", appName)
+	}
+	appGuid, err := appRepo.GetAppGuid(appName)
+	if err != nil {
+		return 0, err
+	}
+	app, err := appRepo.GetApp(appGuid)
+	if err != nil {
+		return 0, err
+	}
+
+	preflight := &Preflight{}
+	venerableName := venerableAppName(appName, venerableSuffix)
+	checks := []struct {
+		description string
+		check       func() error
+	}{
+		{"name of the old app fits", func() error { return checkVenerableName(venerableName) }},
+		{"app is not a Docker app", func() error { return checkNotDocker(appName, app) }},
+		{"app was staged", func() error { return checkStaged(appRepo, appName, appGuid) }},
+		{"app has no active deployment", func() error { return checkNoActiveDeployment(appRepo, appName, appGuid) }},
+		{"app has no running task", func() error { return checkRunningTasks(preflight, appRepo, appName, appGuid) }},
+		{"no app left by a previous stack change", func() error {
+			exists, err := appRepo.DoesAppExist(venerableName)
+			if err == nil && exists {
+				preflight.Warn("app '%s' already exists, a previous stack change of app '%s' likely failed, it must be deleted or --force passed", venerableName, appName)
+			}
+			return err
+		}},
+	}
+
+	fmt.Printf("readiness of app %s, on stack %s:\n", appName, app.Lifecycle.Data.Stack)
+	failed := 0
+	for _, check := range checks {
+		warnings := len(preflight.Warnings)
+		err := check.check()
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("  FAILED   %s: %s\n", check.description, err)
+		case len(preflight.Warnings) > warnings:
+			fmt.Printf("  warning  %s: %s\n", check.description, preflight.Warnings[len(preflight.Warnings)-1])
+		default:
+			fmt.Printf("  ok       %s\n", check.description)
+		}
+	}
+	return failed, nil
+}
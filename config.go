@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// GetAppEnv returns the user-provided environment variables of the app.
+func (repo *ApplicationRepo) GetAppEnv(appGuid string) (map[string]string, error) {
+	var env struct {
+		Var map[string]interface{} `json:"var"`
+	}
+	err := repo.curl(&env, fmt.Sprintf("/v3/apps/%s/environment_variables", url.PathEscape(appGuid)))
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string, len(env.Var))
+	for name, value := range env.Var {
+		if s, ok := value.(string); ok {
+			vars[name] = s
+		} else {
+			vars[name] = fmt.Sprint(value)
+		}
+	}
+	return vars, nil
+}
+
+// GetBoundServices returns the names of the service instances bound to the
+// app.
+func (repo *ApplicationRepo) GetBoundServices(appGuid string) ([]string, error) {
+	var names []string
+	path := fmt.Sprintf("/v3/service_credential_bindings?app_guids=%s&type=app&include=service_instance&per_page=5000", url.QueryEscape(appGuid))
+	err := repo.curlPages(path, func(body []byte) error {
+		// The service instances are included with the page of their
+		// bindings.
+		var bindings struct {
+			Included struct {
+				ServiceInstances []struct {
+					Name string `json:"name"`
+				} `json:"service_instances"`
+			} `json:"included"`
+		}
+		err := json.Unmarshal(body, &bindings)
+		for _, instance := range bindings.Included.ServiceInstances {
+			names = append(names, instance.Name)
+		}
+		return err
+	})
+	return names, err
+}
+
+type Lifecycle struct {
+	Type string `json:"type"`
+	Data struct {
+		Stack      string   `json:"stack,omitempty"`
+		Buildpacks []string `json:"buildpacks,omitempty"`
+	} `json:"data"`
+}
+
+type App struct {
+	GUID      string    `json:"guid"`
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Lifecycle Lifecycle `json:"lifecycle"`
+}
+
+func (repo *ApplicationRepo) GetApp(appGuid string) (App, error) {
+	var app App
+	err := repo.curl(&app, fmt.Sprintf("/v3/apps/%s", url.PathEscape(appGuid)))
+	return app, err
+}
+
+// CreateApp creates a stopped app with the given lifecycle in the current
+// space.
+func (repo *ApplicationRepo) CreateApp(appName string, lifecycle Lifecycle) (App, error) {
+	space, err := repo.conn.GetCurrentSpace()
+	if err != nil {
+		return App{}, err
+	}
+	body := map[string]interface{}{
+		"name":      appName,
+		"lifecycle": lifecycle,
+		"relationships": map[string]interface{}{
+			"space": map[string]interface{}{
+				"data": map[string]string{"guid": space.Guid},
+			},
+		},
+	}
+	var app App
+	err = repo.curlWithBody(&app, "POST", "/v3/apps", body)
+	return app, err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin"
+	plugin_models "code.cloudfoundry.org/cli/plugin/models"
+)
+
+// Connection is the part of plugin.CliConnection ApplicationRepo relies on,
+// so it can be given a fake one.
+type Connection interface {
+	CliCommand(args ...string) ([]string, error)
+	CliCommandWithoutTerminalOutput(args ...string) ([]string, error)
+	GetCurrentSpace() (plugin_models.Space, error)
+}
+
+// serialConnection makes the calls to cf one at a time. The plugin RPC runs a
+// command in three calls sharing the state of the cf CLI, the output of
+// commands run at the same time, by apps migrated in parallel or while a
+// command given up on by watchdogConnection still runs, would get mixed up.
+type serialConnection struct {
+	plugin.CliConnection
+	mutex *sync.Mutex
+}
+
+func newSerialConnection(conn plugin.CliConnection) serialConnection {
+	return serialConnection{CliConnection: conn, mutex: &sync.Mutex{}}
+}
+
+func (conn serialConnection) CliCommand(args ...string) ([]string, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.CliConnection.CliCommand(args...)
+}
+
+func (conn serialConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.CliConnection.CliCommandWithoutTerminalOutput(args...)
+}
+
+func (conn serialConnection) GetCurrentOrg() (plugin_models.Organization, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.CliConnection.GetCurrentOrg()
+}
+
+func (conn serialConnection) GetCurrentSpace() (plugin_models.Space, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.CliConnection.GetCurrentSpace()
+}
+
+// watchdogConnection runs cf commands under a watchdog: it warns when a
+// command takes longer than WarnAfter and gives up on it after Timeout or
+// once the context is done, so a stalled cf makes the stack change roll back
+// rather than freeze. Commands started once the context is done, those of the
+// rollback, are only subject to Timeout. A command given up on can't be killed
+// through the plugin RPC, it is only no longer waited for: Timeout bounds how
+// long the plugin waits before reporting the failure, not how long the command
+// runs. The next command waits for the one given up on to finish, so that
+// their output doesn't get mixed up, and the time spent waiting counts toward
+// WarnAfter and Timeout as do the commands of other apps migrated in parallel.
+type watchdogConnection struct {
+	plugin.CliConnection
+	ctx       context.Context
+	WarnAfter time.Duration
+	Timeout   time.Duration
+	// Output is where the warnings about slow commands are printed.
+	Output io.Writer
+}
+
+// givenUpError is the error of a command the watchdog gave up on, which isn't
+// worth retrying.
+type givenUpError struct {
+	error
+}
+
+func newWatchdogConnection(ctx context.Context, conn plugin.CliConnection, warnAfter, timeout time.Duration) *watchdogConnection {
+	return &watchdogConnection{
+		CliConnection: newSerialConnection(conn),
+		ctx:           ctx,
+		WarnAfter:     warnAfter,
+		Timeout:       timeout,
+		Output:        os.Stdout,
+	}
+}
+
+func (conn *watchdogConnection) CliCommand(args ...string) ([]string, error) {
+	return conn.watch(conn.CliConnection.CliCommand, args)
+}
+
+func (conn *watchdogConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	return conn.watch(conn.CliConnection.CliCommandWithoutTerminalOutput, args)
+}
+
+func (conn *watchdogConnection) watch(command func(...string) ([]string, error), args []string) ([]string, error) {
+	type result struct {
+		output []string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := command(args...)
+		done <- result{output, err}
+	}()
+
+	var warn, timeout <-chan time.Time
+	canceled := conn.ctx.Done()
+	if conn.ctx.Err() != nil {
+		canceled = nil
+	}
+	if conn.WarnAfter > 0 {
+		timer := time.NewTimer(conn.WarnAfter)
+		defer timer.Stop()
+		warn = timer.C
+	}
+	if conn.Timeout > 0 {
+		timer := time.NewTimer(conn.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case r := <-done:
+			return r.output, r.err
+		case <-warn:
+			fmt.Fprintf(conn.Output, "cf %s is taking unusually long (over %s)\n", args[0], conn.WarnAfter)
+			warn = nil
+		case <-timeout:
+			return nil, givenUpError{fmt.Errorf("cf %s timed out after %s", args[0], conn.Timeout)}
+		case <-canceled:
+			return nil, givenUpError{fmt.Errorf("cf %s abandoned: %s", args[0], conn.ctx.Err())}
+		}
+	}
+}
+
+// commandOutput is where the cf commands run are printed with --verbose.
+var commandOutput io.Writer = os.Stderr
+
+// verboseConnection prints each cf command to commandOutput before running
+// it, prefixed with the name of the app as the output of apps migrated in
+// parallel is, the values of environment variables being redacted.
+type verboseConnection struct {
+	plugin.CliConnection
+	appName string
+}
+
+func (conn verboseConnection) CliCommand(args ...string) ([]string, error) {
+	printCommand(conn.appName, args)
+	return conn.CliConnection.CliCommand(args...)
+}
+
+func (conn verboseConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	printCommand(conn.appName, args)
+	return conn.CliConnection.CliCommandWithoutTerminalOutput(args...)
+}
+
+func printCommand(appName string, args []string) {
+	fmt.Fprintf(commandOutput, "[%s] $ cf %s\n", appName, formatCommand(args))
+}
+
+// formatCommand quotes the arguments of a cf command as needed to be run in a
+// shell, the values of environment variables being redacted.
+func formatCommand(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for i, arg := range args {
+		if i > 0 && args[i-1] == "-d" {
+			arg = redactBody(arg)
+		}
+		if strings.ContainsAny(arg, " \"'{}") {
+			arg = "'" + arg + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// redactBody hides the values of the environment variables in the JSON body
+// of a request.
+func redactBody(body string) string {
+	var fields map[string]interface{}
+	if json.Unmarshal([]byte(body), &fields) != nil {
+		return body
+	}
+	vars, ok := fields["var"].(map[string]interface{})
+	if !ok {
+		return body
+	}
+	for name := range vars {
+		vars[name] = "[REDACTED]"
+	}
+	redacted, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return string(redacted)
+}
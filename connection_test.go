@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin"
+	plugin_models "code.cloudfoundry.org/cli/plugin/models"
+)
+
+// fakeCF is a cf run through the plugin RPC for tests. It keeps the apps of a
+// space by name, answers cf curl as a Cloud Controller whose apps are staged,
+// run and hold a ready package would, and records every command run. Only
+// the methods of Connection are implemented.
+type fakeCF struct {
+	plugin.CliConnection
+
+	mutex    sync.Mutex
+	apps     map[string]string
+	lastGUID int
+	commands [][]string
+	// fail makes the cf commands with the given name fail, e.g. push.
+	fail map[string]bool
+	// notRunning makes the instances of the apps with the given names
+	// stay STARTING.
+	notRunning map[string]bool
+	// curl, unless nil, answers the requests of cf curl before the fake
+	// does, a 0 status leaving the request to the fake.
+	curl func(method, path string) (int, string)
+	// callDelay makes each call take at least that long, so calls made at
+	// the same time overlap.
+	callDelay time.Duration
+	inFlight  int32
+	// overlapped is set once a call started before another returned.
+	overlapped int32
+}
+
+func newFakeCF(appNames ...string) *fakeCF {
+	cf := &fakeCF{apps: map[string]string{}, fail: map[string]bool{}, notRunning: map[string]bool{}}
+	for _, appName := range appNames {
+		cf.create(appName)
+	}
+	return cf
+}
+
+func (cf *fakeCF) create(appName string) string {
+	cf.lastGUID++
+	guid := fmt.Sprintf("00000000-0000-0000-0000-%012d", cf.lastGUID)
+	cf.apps[appName] = guid
+	return guid
+}
+
+func (cf *fakeCF) CliCommand(args ...string) ([]string, error) {
+	return cf.run(args)
+}
+
+func (cf *fakeCF) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	return cf.run(args)
+}
+
+func (cf *fakeCF) GetCurrentSpace() (plugin_models.Space, error) {
+	if atomic.AddInt32(&cf.inFlight, 1) > 1 {
+		atomic.StoreInt32(&cf.overlapped, 1)
+	}
+	defer atomic.AddInt32(&cf.inFlight, -1)
+	return plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Guid: "space-guid", Name: "space"}}, nil
+}
+
+// ran tells whether the command was run.
+func (cf *fakeCF) ran(args ...string) bool {
+	cf.mutex.Lock()
+	defer cf.mutex.Unlock()
+	for _, command := range cf.commands {
+		if strings.Join(command, " ") == strings.Join(args, " ") {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns the number of cf commands with the given name run.
+func (cf *fakeCF) count(name string) int {
+	cf.mutex.Lock()
+	defer cf.mutex.Unlock()
+	count := 0
+	for _, command := range cf.commands {
+		if command[0] == name {
+			count++
+		}
+	}
+	return count
+}
+
+// curlPaths returns the paths requested with cf curl, in order.
+func (cf *fakeCF) curlPaths() []string {
+	cf.mutex.Lock()
+	defer cf.mutex.Unlock()
+	var paths []string
+	for _, command := range cf.commands {
+		if command[0] == "curl" {
+			paths = append(paths, curlPath(command[1:]))
+		}
+	}
+	return paths
+}
+
+func (cf *fakeCF) run(args []string) ([]string, error) {
+	if atomic.AddInt32(&cf.inFlight, 1) > 1 {
+		atomic.StoreInt32(&cf.overlapped, 1)
+	}
+	defer atomic.AddInt32(&cf.inFlight, -1)
+	time.Sleep(cf.callDelay)
+
+	cf.mutex.Lock()
+	defer cf.mutex.Unlock()
+	cf.commands = append(cf.commands, args)
+	if cf.fail[args[0]] {
+		return nil, errors.New("Error executing cli core command")
+	}
+
+	switch args[0] {
+	case "app":
+		guid, ok := cf.apps[args[1]]
+		if !ok {
+			return nil, fmt.Errorf("App '%s' not found.", args[1])
+		}
+		return []string{guid}, nil
+	case "rename":
+		guid, ok := cf.apps[args[1]]
+		if !ok {
+			return nil, fmt.Errorf("App '%s' not found.", args[1])
+		}
+		delete(cf.apps, args[1])
+		cf.apps[args[2]] = guid
+	case "delete":
+		delete(cf.apps, args[1])
+	case "push":
+		if _, ok := cf.apps[args[1]]; !ok {
+			cf.create(args[1])
+		}
+	case "create-app-manifest":
+		manifest := fmt.Sprintf("applications:\n- name: %s\n  memory: 256M\n  instances: 1\n  routes:\n  - route: %s.example.com\n", args[1], args[1])
+		return nil, ioutil.WriteFile(args[3], []byte(manifest), 0600)
+	case "curl":
+		args = args[1:]
+		if args[0] == "-i" {
+			args = args[1:]
+		}
+		status, body := cf.answer(curlMethod(args), curlPath(args))
+		return []string{fmt.Sprintf("HTTP/1.1 %d %s", status, http.StatusText(status)), "Content-Type: application/json", "", body}, nil
+	}
+	return nil, nil
+}
+
+var fakeAppPath = regexp.MustCompile(`^/v3/apps/([^/?]+)(/[^?]*)?`)
+
+func (cf *fakeCF) answer(method, requestPath string) (int, string) {
+	if cf.curl != nil {
+		if status, body := cf.curl(method, requestPath); status != 0 {
+			return status, body
+		}
+	}
+	u, err := url.Parse("/" + strings.TrimPrefix(requestPath, "/"))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Sprintf(`{"errors":[{"code":10005,"title":"CF-BadQueryParameter","detail":"%s"}]}`, err)
+	}
+
+	switch {
+	case u.Path == "/v2/apps":
+		count := 0
+		for _, q := range u.Query()["q"] {
+			if _, ok := cf.apps[strings.TrimPrefix(q, "name:")]; ok && strings.HasPrefix(q, "name:") {
+				count++
+			}
+		}
+		return http.StatusOK, fmt.Sprintf(`{"total_results":%d,"resources":[]}`, count)
+	case u.Path == "/v3/stacks":
+		return http.StatusOK, fmt.Sprintf(`{"resources":[{"name":"%s"}],"pagination":{}}`, u.Query().Get("names"))
+	case u.Path == "/v3/packages" && method == http.MethodPost:
+		return http.StatusCreated, `{"guid":"copied-package-guid","state":"COPYING"}`
+	case strings.HasPrefix(u.Path, "/v3/packages/"):
+		return http.StatusOK, fmt.Sprintf(`{"guid":"%s","state":"READY"}`, path.Base(u.Path))
+	case u.Path == "/v3/droplets" && method == http.MethodPost:
+		return http.StatusCreated, `{"guid":"copied-droplet-guid","state":"STAGED"}`
+	case strings.HasPrefix(u.Path, "/v3/jobs/"):
+		return http.StatusOK, fmt.Sprintf(`{"guid":"%s","state":"COMPLETE"}`, path.Base(u.Path))
+	}
+
+	match := fakeAppPath.FindStringSubmatch(u.Path)
+	if match == nil {
+		return http.StatusOK, `{"resources":[],"pagination":{}}`
+	}
+	guid, resource := match[1], match[2]
+	appName := ""
+	for name, appGuid := range cf.apps {
+		if appGuid == guid {
+			appName = name
+		}
+	}
+	if appName == "" {
+		return http.StatusNotFound, `{"errors":[{"code":10010,"title":"CF-ResourceNotFound","detail":"App not found"}]}`
+	}
+	switch resource {
+	case "":
+		return http.StatusOK, fmt.Sprintf(`{"guid":"%s","name":"%s","state":"STARTED","lifecycle":{"type":"buildpack","data":{"stack":"cflinuxfs3","buildpacks":[]}}}`, guid, appName)
+	case "/droplets/current":
+		return http.StatusOK, `{"guid":"droplet-guid","state":"STAGED"}`
+	case "/packages":
+		return http.StatusOK, fmt.Sprintf(`{"resources":[{"guid":"package-of-%s","type":"bits","state":"READY"}],"pagination":{}}`, guid)
+	case "/processes":
+		return http.StatusOK, fmt.Sprintf(`{"resources":[{"guid":"web-of-%s","type":"web","instances":1,"memory_in_mb":256,"disk_in_mb":1024,"health_check":{"type":"port","data":{}}}],"pagination":{}}`, guid)
+	case "/processes/web":
+		return http.StatusOK, fmt.Sprintf(`{"guid":"web-of-%s","type":"web","instances":1,"health_check":{"type":"port","data":{}}}`, guid)
+	case "/processes/web/stats":
+		state := "RUNNING"
+		if cf.notRunning[appName] {
+			state = "STARTING"
+		}
+		return http.StatusOK, fmt.Sprintf(`{"resources":[{"index":0,"state":"%s"}]}`, state)
+	case "/environment_variables":
+		return http.StatusOK, `{"var":{}}`
+	}
+	return http.StatusOK, `{"resources":[],"pagination":{}}`
+}
+
+// testRepo returns a repo on the fake cf polling every millisecond.
+func testRepo(t *testing.T, cf *fakeCF) *ApplicationRepo {
+	t.Helper()
+	repo, err := NewApplicationRepoIn(cf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.PollInterval = time.Millisecond
+	repo.RetryBackoff = time.Millisecond
+	repo.out = ioutil.Discard
+	return repo
+}
+
+func TestWatchdogWaitsForCommandGivenUpOn(t *testing.T) {
+	cf := newFakeCF("app")
+	cf.callDelay = 50 * time.Millisecond
+	conn := newWatchdogConnection(context.Background(), cf, 0, 10*time.Millisecond)
+
+	_, err := conn.CliCommandWithoutTerminalOutput("app", "app", "--guid")
+	if _, givenUp := err.(givenUpError); !givenUp {
+		t.Fatalf("the slow command returned %v, want it given up on", err)
+	}
+	conn.Timeout = time.Second
+	_, err = conn.CliCommandWithoutTerminalOutput("app", "app", "--guid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&cf.overlapped) != 0 {
+		t.Error("a command started before the one given up on returned")
+	}
+}
+
+func TestVerboseConnectionPrefixesCommandsWithAppName(t *testing.T) {
+	var out bytes.Buffer
+	commandOutput = &out
+	defer func() { commandOutput = os.Stderr }()
+	conn := verboseConnection{newFakeCF("app"), "app"}
+
+	conn.CliCommand("restart", "app")
+	conn.CliCommandWithoutTerminalOutput("app", "app", "--guid")
+
+	want := "[app] $ cf restart app\n[app] $ cf app app --guid\n"
+	if out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+}
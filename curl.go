@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// curlResponse is the response to a request sent with `cf curl -i`.
+type curlResponse struct {
+	// Status is the HTTP status of the response, or 0 if cf didn't print
+	// it.
+	Status int
+	Header map[string]string
+	Body   []byte
+}
+
+// parseCurlOutput splits the output of `cf curl -i` into the status, headers
+// and body of the response.
+func parseCurlOutput(lines []string) curlResponse {
+	response := curlResponse{Header: map[string]string{}}
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "HTTP/") {
+		response.Body = []byte(strings.Join(lines, "\n"))
+		return response
+	}
+
+	fields := strings.Fields(lines[0])
+	if len(fields) > 1 {
+		response.Status, _ = strconv.Atoi(fields[1])
+	}
+	i := 1
+	for ; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if line == "" {
+			i++
+			break
+		}
+		header := strings.SplitN(line, ":", 2)
+		if len(header) == 2 {
+			response.Header[strings.ToLower(strings.TrimSpace(header[0]))] = strings.TrimSpace(header[1])
+		}
+	}
+	if i < len(lines) {
+		response.Body = []byte(strings.Join(lines[i:], "\n"))
+	}
+	return response
+}
+
+// curlRaw runs `cf curl -i` with the given arguments. Failures to run it and
+// server errors of GET requests are retried up to repo.CurlAttempts times in
+// all, waiting repo.RetryBackoff then twice as long each time, as the Cloud
+// Controller may be briefly unavailable. Other requests aren't retried, as
+// they may have been carried out despite the error. The waits end once the
+// context of the repo is done. Requests refused by the rate limit of the Cloud
+// Controller are sent again once it lets them through, as told by the
+// Retry-After header, waiting at most maxRetryAfter at a time and
+// repo.RateLimitWait in all. Other client errors are returned as responses.
+func (repo *ApplicationRepo) curlRaw(args ...string) (curlResponse, error) {
+	ctx := rollbackContext(repo.context())
+	backoff := repo.RetryBackoff
+	var rateLimited time.Duration
+	for attempt := 1; ; attempt++ {
+		lines, err := repo.conn.CliCommandWithoutTerminalOutput(append([]string{"curl", "-i"}, args...)...)
+		var response curlResponse
+		if err == nil {
+			response = parseCurlOutput(lines)
+			if response.Status == http.StatusTooManyRequests {
+				wait := retryAfter(response.Header["retry-after"], backoff)
+				if wait > maxRetryAfter {
+					wait = maxRetryAfter
+				}
+				if rateLimited+wait > repo.RateLimitWait {
+					return response, fmt.Errorf("%s: rate limited by the Cloud Controller for more than %s", curlPath(args), repo.RateLimitWait)
+				}
+				repo.printf("warning: %s: rate limited by the Cloud Controller, retrying in %s\n", curlPath(args), wait)
+				err = sleep(ctx, wait)
+				if err != nil {
+					return response, fmt.Errorf("%s: rate limited by the Cloud Controller: %s", curlPath(args), err)
+				}
+				rateLimited += wait
+				// Waiting for the rate limit isn't a failed attempt.
+				attempt--
+				continue
+			}
+			if response.Status < 500 {
+				return response, nil
+			}
+			err = fmt.Errorf("%s: %d %s", curlPath(args), response.Status, strings.TrimSpace(string(response.Body)))
+		}
+		if _, givenUp := err.(givenUpError); givenUp || attempt >= repo.CurlAttempts || curlMethod(args) != http.MethodGet {
+			return response, err
+		}
+		repo.printf("warning: %s, retrying in %s\n", err, backoff)
+		if sleep(ctx, backoff) != nil {
+			return response, err
+		}
+		backoff *= 2
+	}
+}
+
+// maxRetryAfter is the longest time waited at once for the rate limit, the
+// request being sent again afterwards even if Retry-After asked for more.
+const maxRetryAfter = time.Minute
+
+// retryAfter returns the time to wait given by a Retry-After header, either in
+// seconds or as a date, or the default wait if the header is missing or
+// invalid.
+func retryAfter(header string, defaultWait time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && time.Until(date) > 0 {
+		return time.Until(date).Round(time.Second)
+	}
+	return defaultWait
+}
+
+// curlOutput runs `cf curl` like curlRaw and returns the lines of the body of
+// the response.
+func (repo *ApplicationRepo) curlOutput(args ...string) ([]string, error) {
+	response, err := repo.curlRaw(args...)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(response.Body), "\n"), nil
+}
+
+// curlMethod returns the method of the request sent by cf curl with the given
+// arguments: the one given with -X, else POST when a body is given with -d, as
+// cf curl does, else GET.
+func curlMethod(args []string) string {
+	method := http.MethodGet
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-X":
+			return strings.ToUpper(args[i+1])
+		case "-d":
+			method = http.MethodPost
+		}
+	}
+	return method
+}
+
+// curlPath returns the path among the arguments of cf curl.
+func curlPath(args []string) string {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-X" || args[i] == "-d" || args[i] == "-H":
+			i++
+		case !strings.HasPrefix(args[i], "-"):
+			return args[i]
+		}
+	}
+	return "cf curl"
+}
+
+// curl runs `cf curl` with the given arguments and decodes the JSON response
+// into v, which may be nil when the body is not needed. Errors reported by the
+// v3 API in the response body are returned as errors.
+func (repo *ApplicationRepo) curl(v interface{}, args ...string) error {
+	response, err := repo.curlRaw(args...)
+	if err != nil {
+		return err
+	}
+	resp := response.Body
+	err = responseError(resp)
+	if err != nil {
+		return err
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(resp, v)
+}
+
+// responseError returns the first error reported by the v3 API in the body of
+// a response, if any.
+func responseError(body []byte) error {
+	// Failed jobs report their errors along with their guid, the body is
+	// then the resource and not an error.
+	var apiErrors struct {
+		GUID   string     `json:"guid"`
+		Errors []APIError `json:"errors"`
+	}
+	if json.Unmarshal(body, &apiErrors) == nil && len(apiErrors.Errors) > 0 && apiErrors.GUID == "" {
+		return apiErrors.Errors[0]
+	}
+	return nil
+}
+
+// curlPages gets each page of a list of resources of the v2 or v3 API from the
+// given path, following the links to the next pages, and passes their bodies
+// to page in turn.
+func (repo *ApplicationRepo) curlPages(path string, page func(body []byte) error) error {
+	for path != "" {
+		response, err := repo.curlRaw(path)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Errors     []APIError `json:"errors"`
+			Pagination struct {
+				Next *struct {
+					Href string `json:"href"`
+				} `json:"next"`
+			} `json:"pagination"`
+			NextURL string `json:"next_url"`
+		}
+		err = json.Unmarshal(response.Body, &body)
+		if err != nil {
+			return fmt.Errorf("invalid response to %s: %s", path, err)
+		}
+		if len(body.Errors) > 0 {
+			return body.Errors[0]
+		}
+		err = page(response.Body)
+		if err != nil {
+			return err
+		}
+
+		path = body.NextURL
+		if body.Pagination.Next != nil {
+			// v3 links are absolute, cf curl takes paths.
+			next, err := url.Parse(body.Pagination.Next.Href)
+			if err != nil {
+				return err
+			}
+			path = next.RequestURI()
+		}
+	}
+	return nil
+}
+
+// curlAll gets the resources of every page of a list from the given path, as
+// curlPages, and decodes them into resources, a pointer to a slice.
+func (repo *ApplicationRepo) curlAll(resources interface{}, path string) error {
+	all := reflect.ValueOf(resources).Elem()
+	return repo.curlPages(path, func(body []byte) error {
+		page := reflect.New(all.Type())
+		err := json.Unmarshal(body, &struct {
+			Resources interface{} `json:"resources"`
+		}{page.Interface()})
+		if err != nil {
+			return err
+		}
+		all.Set(reflect.AppendSlice(all, page.Elem()))
+		return nil
+	})
+}
+
+// curlWithBody sends the JSON encoding of body with the given method using
+// curl.
+func (repo *ApplicationRepo) curlWithBody(v interface{}, method, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return repo.curl(v, "-X", method, path, "-d", string(data))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigDiff lists what the live configuration of an app has that its
+// manifest doesn't capture.
+type ConfigDiff struct {
+	Lines []string
+}
+
+func (diff *ConfigDiff) add(format string, args ...interface{}) {
+	diff.Lines = append(diff.Lines, fmt.Sprintf(format, args...))
+}
+
+func (diff ConfigDiff) Print(out io.Writer) {
+	if len(diff.Lines) == 0 {
+		fmt.Fprintln(out, "the manifest captures the live configuration of the app")
+		return
+	}
+	fmt.Fprintln(out, "the manifest doesn't capture this live configuration of the app:")
+	for _, line := range diff.Lines {
+		fmt.Fprintln(out, "  "+line)
+	}
+}
+
+// DiffManifest compares the manifest entry of an app with its live env,
+// services and processes. Env values are never printed as they may hold
+// secrets.
+func DiffManifest(app map[string]interface{}, env map[string]string, services []string, processes []Process) ConfigDiff {
+	var diff ConfigDiff
+
+	manifestEnv, _ := app["env"].(map[interface{}]interface{})
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := manifestEnv[name]
+		if !ok {
+			diff.add("env %s: set on the app, missing from the manifest", name)
+		} else if fmt.Sprint(value) != env[name] {
+			diff.add("env %s: value differs from the manifest", name)
+		}
+	}
+
+	manifestServices := map[string]bool{}
+	for _, service := range listValue(app["services"]) {
+		if m, ok := service.(map[interface{}]interface{}); ok {
+			service = m["name"]
+		}
+		manifestServices[fmt.Sprint(service)] = true
+	}
+	for _, service := range services {
+		if !manifestServices[service] {
+			diff.add("service %s: bound to the app, missing from the manifest", service)
+		}
+	}
+
+	for _, process := range processes {
+		manifestProcess := manifestProcess(app, process.Type)
+		if manifestProcess == nil {
+			diff.add("process %s: missing from the manifest", process.Type)
+			continue
+		}
+		if instances, ok := manifestProcess["instances"].(int); !ok || instances != process.Instances {
+			diff.add("process %s instances: %d live, %v in the manifest", process.Type, process.Instances, manifestProcess["instances"])
+		}
+		if megabytes(manifestProcess["memory"]) != process.MemoryInMB {
+			diff.add("process %s memory: %dM live, %v in the manifest", process.Type, process.MemoryInMB, manifestProcess["memory"])
+		}
+		if megabytes(manifestProcess["disk_quota"]) != process.DiskInMB {
+			diff.add("process %s disk: %dM live, %v in the manifest", process.Type, process.DiskInMB, manifestProcess["disk_quota"])
+		}
+	}
+	return diff
+}
+
+// manifestProcess returns the manifest entry of the given process type. The
+// web process may be described at the top level of the app entry.
+func manifestProcess(app map[string]interface{}, processType string) map[interface{}]interface{} {
+	for _, process := range listValue(app["processes"]) {
+		if m, ok := process.(map[interface{}]interface{}); ok && m["type"] == processType {
+			return m
+		}
+	}
+	if processType != "web" {
+		return nil
+	}
+	web := map[interface{}]interface{}{}
+	for key, value := range app {
+		web[key] = value
+	}
+	return web
+}
+
+func listValue(v interface{}) []interface{} {
+	list, _ := v.([]interface{})
+	return list
+}
+
+// megabytes converts a manifest memory or disk value such as 1G or 512M to
+// megabytes, returning -1 if it can't.
+func megabytes(v interface{}) int {
+	s := strings.ToUpper(strings.TrimSpace(fmt.Sprint(v)))
+	s = strings.TrimSuffix(s, "B")
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1024
+		s = strings.TrimSuffix(s, "G")
+	case strings.HasSuffix(s, "M"):
+		s = strings.TrimSuffix(s, "M")
+	default:
+		return -1
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+	return n * multiplier
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+type Droplet struct {
+	GUID  string `json:"guid"`
+	State string `json:"state"`
+	Stack string `json:"stack"`
+	Error string `json:"error"`
+}
+
+func (repo *ApplicationRepo) GetCurrentDroplet(appGuid string) (Droplet, error) {
+	var droplet Droplet
+	err := repo.curl(&droplet, fmt.Sprintf("/v3/apps/%s/droplets/current", url.PathEscape(appGuid)))
+	return droplet, err
+}
+
+// The codes of the v3 API errors the plugin tells apart.
+const (
+	resourceNotFound = 10010
+	featureDisabled  = 330002
+)
+
+// isCopyBitsDisabled tells whether the error is the refusal to copy a package
+// where the copy_bits feature flag is disabled. Other refusals, such as a
+// user not allowed to copy, are errors of their own and not told apart.
+func isCopyBitsDisabled(err error) bool {
+	apiErr, ok := err.(APIError)
+	return ok && apiErr.Code == featureDisabled
+}
+
+// HasCurrentDroplet tells whether the app has a current droplet, which it
+// lacks until it was staged successfully.
+func (repo *ApplicationRepo) HasCurrentDroplet(appGuid string) (bool, error) {
+	_, err := repo.GetCurrentDroplet(appGuid)
+	if apiErr, ok := err.(APIError); ok && apiErr.Code == resourceNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (repo *ApplicationRepo) GetDroplet(dropletGuid string) (Droplet, error) {
+	var droplet Droplet
+	err := repo.curl(&droplet, fmt.Sprintf("/v3/droplets/%s", url.PathEscape(dropletGuid)))
+	return droplet, err
+}
+
+// CopyPackage copies the package to the app and waits for the copy to be
+// ready.
+func (repo *ApplicationRepo) CopyPackage(ctx context.Context, packageGuid, appGuid string) (Package, error) {
+	body := map[string]interface{}{
+		"relationships": map[string]interface{}{
+			"app": map[string]interface{}{
+				"data": map[string]string{"guid": appGuid},
+			},
+		},
+	}
+	var pkg Package
+	err := repo.curlWithBody(&pkg, "POST", fmt.Sprintf("/v3/packages?source_guid=%s", url.QueryEscape(packageGuid)), body)
+	if err != nil {
+		return pkg, err
+	}
+
+	start := time.Now()
+	for pkg.State != "READY" {
+		if pkg.State == "FAILED" || pkg.State == "EXPIRED" {
+			return pkg, fmt.Errorf("copy of package %s is %s", packageGuid, pkg.State)
+		}
+		if time.Since(start) > repo.PollTimeout {
+			return pkg, fmt.Errorf("copy of package %s did not finish within %s", packageGuid, repo.PollTimeout)
+		}
+		err = sleep(ctx, repo.PollInterval)
+		if err != nil {
+			return pkg, err
+		}
+		err = repo.curl(&pkg, fmt.Sprintf("/v3/packages/%s", url.PathEscape(pkg.GUID)))
+		if err != nil {
+			return pkg, err
+		}
+	}
+	return pkg, nil
+}
+
+// CopyDroplet copies the droplet to the app and waits for the copy to be
+// staged.
+func (repo *ApplicationRepo) CopyDroplet(ctx context.Context, dropletGuid, appGuid string) (Droplet, error) {
+	body := map[string]interface{}{
+		"relationships": map[string]interface{}{
+			"app": map[string]interface{}{
+				"data": map[string]string{"guid": appGuid},
+			},
+		},
+	}
+	var droplet Droplet
+	err := repo.curlWithBody(&droplet, "POST", fmt.Sprintf("/v3/droplets?source_guid=%s", url.QueryEscape(dropletGuid)), body)
+	if err != nil {
+		return droplet, err
+	}
+
+	start := time.Now()
+	for droplet.State != "STAGED" {
+		if droplet.State == "FAILED" || droplet.State == "EXPIRED" {
+			return droplet, fmt.Errorf("copy of droplet %s is %s: %s", dropletGuid, droplet.State, droplet.Error)
+		}
+		if time.Since(start) > repo.PollTimeout {
+			return droplet, fmt.Errorf("copy of droplet %s did not finish within %s", dropletGuid, repo.PollTimeout)
+		}
+		err = sleep(ctx, repo.PollInterval)
+		if err != nil {
+			return droplet, err
+		}
+		droplet, err = repo.GetDroplet(droplet.GUID)
+		if err != nil {
+			return droplet, err
+		}
+	}
+	return droplet, nil
+}
+
+// Build is a build of the v3 API, staging a package into a droplet.
+type Build struct {
+	GUID    string `json:"guid"`
+	State   string `json:"state"`
+	Error   string `json:"error"`
+	Droplet *struct {
+		GUID string `json:"guid"`
+	} `json:"droplet"`
+}
+
+// StageApplication stages the latest package of the app into a droplet which
+// becomes its current droplet, without starting the app.
+func (repo *ApplicationRepo) StageApplication(ctx context.Context, appGuid string) error {
+	pkg, err := repo.GetLatestReadyPackage(appGuid)
+	if err != nil {
+		return err
+	}
+	if pkg == nil {
+		return fmt.Errorf("app %s has no package to stage", appGuid)
+	}
+	body := map[string]interface{}{
+		"package": map[string]string{"guid": pkg.GUID},
+	}
+	var build Build
+	err = repo.curlWithBody(&build, "POST", "/v3/builds", body)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	for build.State != "STAGED" {
+		if build.State == "FAILED" {
+			return fmt.Errorf("staging of package %s failed: %s", pkg.GUID, build.Error)
+		}
+		if time.Since(start) > repo.PollTimeout {
+			return fmt.Errorf("staging of package %s did not finish within %s", pkg.GUID, repo.PollTimeout)
+		}
+		err = sleep(ctx, repo.PollInterval)
+		if err != nil {
+			return err
+		}
+		err = repo.curl(&build, fmt.Sprintf("/v3/builds/%s", url.PathEscape(build.GUID)))
+		if err != nil {
+			return err
+		}
+	}
+	if build.Droplet == nil {
+		return fmt.Errorf("staging of package %s didn't produce a droplet", pkg.GUID)
+	}
+	return repo.SetCurrentDroplet(appGuid, build.Droplet.GUID)
+}
+
+// DownloadDroplet downloads the current droplet of the app to the temp dir and
+// returns its path.
+func (repo *ApplicationRepo) DownloadDroplet(appName string) (string, error) {
+	path := filepath.Join(repo.dir, "droplet.tgz")
+	_, err := repo.conn.CliCommand("download-droplet", appName, "--path", path)
+	return path, err
+}
+
+// PushPackageOf downloads the latest ready package of the source app to the
+// temp dir and pushes the app from it without starting it, the way to give it
+// the bits of the source app when they can't be copied.
+func (repo *ApplicationRepo) PushPackageOf(sourceAppGuid, appName string) error {
+	pkg, err := repo.GetLatestReadyPackage(sourceAppGuid)
+	if err != nil {
+		return err
+	}
+	if pkg == nil {
+		return fmt.Errorf("app %s has no package to download", sourceAppGuid)
+	}
+	path := filepath.Join(repo.dir, "package.zip")
+	_, err = repo.conn.CliCommandWithoutTerminalOutput("curl", fmt.Sprintf("/v3/packages/%s/download", url.PathEscape(pkg.GUID)), "--output", path)
+	if err != nil {
+		return fmt.Errorf("failed to download package %s: %s", pkg.GUID, err)
+	}
+	_, err = repo.conn.CliCommand("push", appName, "-f", repo.manifestFilePath(), "-p", path, "--no-start")
+	if err != nil {
+		return fmt.Errorf("cf push %s failed: %s", appName, err)
+	}
+	return nil
+}
+
+// PushApplicationWithDroplet pushes the app from its manifest with the given
+// droplet instead of bits, without starting it. The output of cf push is
+// shown as it runs.
+func (repo *ApplicationRepo) PushApplicationWithDroplet(appName, dropletPath string) error {
+	_, err := repo.conn.CliCommand("push", appName, "-f", repo.manifestFilePath(), "--droplet", dropletPath, "--no-start")
+	if err != nil {
+		return fmt.Errorf("cf push %s failed: %s", appName, err)
+	}
+	return nil
+}
+
+func (repo *ApplicationRepo) SetCurrentDroplet(appGuid, dropletGuid string) error {
+	body := map[string]interface{}{
+		"data": map[string]string{"guid": dropletGuid},
+	}
+	return repo.curlWithBody(nil, "PATCH", fmt.Sprintf("/v3/apps/%s/relationships/current_droplet", url.PathEscape(appGuid)), body)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	pushStrategy    = "push"
+	dropletStrategy = "droplet"
+)
+
+// dropletChangeStackActions changes the stack of the app like the push
+// strategy, except the new app is created through the v3 API with the
+// lifecycle of the old app rather than pushed from its manifest, and given a
+// copy of its droplet to start without staging, along with a copy of its
+// package to be restaged on the new stack. Neither a manifest nor a temp dir
+// is involved, for apps whose manifest can't be relied on.
+func dropletChangeStackActions(ctx context.Context, appRepo *ApplicationRepo, appName string, newStackName string, options changeStackOptions, state *StateFile) Plan {
+	venerableName := venerableAppName(appName, options.VenerableSuffix)
+	var oldApp App
+
+	restoreVenerable := func() error {
+		releaseNewApp(appRepo, appName, *state)
+		return restoreVenerableApp(appRepo, appName, venerableName)
+	}
+	appGuids := func() (string, string, error) {
+		oldAppGuid, err := appRepo.GetAppGuid(venerableName)
+		if err != nil {
+			return "", "", err
+		}
+		newAppGuid, err := appRepo.GetAppGuid(appName)
+		return oldAppGuid, newAppGuid, err
+	}
+
+	plan := changeStackActions(ctx, appRepo, appName, newStackName, options, state)
+	plan.CutoverStep = "create_app"
+	plan.Replace("create_manifest", Step{
+		Name:        "capture_app",
+		State:       StateCaptured,
+		Description: fmt.Sprintf("get the lifecycle of app %s", appName),
+		Rationale:   "the new app is created with the stack and buildpacks of the old one, to run its droplet",
+		Forward: func() error {
+			appGuid, err := appRepo.GetAppGuid(appName)
+			if err != nil {
+				return err
+			}
+			oldApp, err = appRepo.GetApp(appGuid)
+			return err
+		},
+	})
+	plan.Replace("pin_buildpacks")
+	plan.Replace("check_manifest")
+	plan.Replace("touch_dir")
+	plan.Replace("push", Step{
+		Name:        "create_app",
+		State:       StatePushed,
+		Description: fmt.Sprintf("create app %s", appName),
+		Rationale:   "the v3 API creates an app from its lifecycle alone, without a manifest or bits to push",
+		Forward: func() error {
+			if oldApp.GUID == "" {
+				// Resumed after the app was captured.
+				oldAppGuid, err := appRepo.GetAppGuid(venerableName)
+				if err != nil {
+					return err
+				}
+				oldApp, err = appRepo.GetApp(oldAppGuid)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := appRepo.CreateApp(appName, oldApp.Lifecycle)
+			return err
+		},
+		Reverse: restoreVenerable,
+	})
+	plan.Replace("copy_bits", Step{
+		Name:        "copy_bits",
+		State:       StateCopied,
+		Description: fmt.Sprintf("copy the package and droplet of app %s to app %s", venerableName, appName),
+		Rationale:   "the droplet lets the new app start without staging, the package lets it be restaged on the new stack",
+		Forward: func() error {
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			pkg, err := appRepo.GetLatestReadyPackage(oldAppGuid)
+			if err != nil {
+				return err
+			}
+			if pkg == nil {
+				return fmt.Errorf("app %s has no package to restage from", venerableName)
+			}
+			_, err = appRepo.CopyPackage(ctx, pkg.GUID, newAppGuid)
+			if err != nil {
+				return err
+			}
+			droplet, err := appRepo.GetCurrentDroplet(oldAppGuid)
+			if err != nil {
+				return err
+			}
+			droplet, err = appRepo.CopyDroplet(ctx, droplet.GUID, newAppGuid)
+			if err != nil {
+				return err
+			}
+			return appRepo.SetCurrentDroplet(newAppGuid, droplet.GUID)
+		},
+		Reverse: restoreVenerable,
+	})
+	plan.Replace("restart", Step{
+		Name:        "start",
+		State:       StateCopied,
+		Description: fmt.Sprintf("start app %s with the copied droplet", appName),
+		Rationale:   "starting the new app on the old stack puts it on the routes alongside the old app",
+		Forward: func() error {
+			appRepo.printf("\n")
+			return appRepo.StartApplication(appName)
+		},
+		Reverse: restoreVenerable,
+	})
+	return plan
+}
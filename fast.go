@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// fastChangeStackActions changes the stack of the app in place, restaging it
+// on the new stack. This is quicker than the blue-green flow but the app is
+// down while it restages.
+func fastChangeStackActions(ctx context.Context, appRepo *ApplicationRepo, appName string, newStackName string) Plan {
+	var appGuid, oldStackName string
+
+	plan := Plan{
+		RewindFailureMessage: "Oh no. Something's gone wrong. I've tried to restore the old stack but you should check to see if everything is OK.",
+		CutoverStep:          "restage",
+	}
+	plan.Add(
+		Step{
+			Name:        "capture_stack",
+			Description: fmt.Sprintf("read the current stack of app %s", appName),
+			Rationale:   "the old stack is needed to roll back if the restage fails",
+			Forward: func() error {
+				var err error
+				appGuid, err = appRepo.GetAppGuid(appName)
+				if err != nil {
+					return err
+				}
+				app, err := appRepo.GetApp(appGuid)
+				oldStackName = app.Lifecycle.Data.Stack
+				return err
+			},
+		},
+		Step{
+			Name:        "change_stack",
+			Description: fmt.Sprintf("change the stack of app %s to %s", appName, newStackName),
+			Rationale:   "the stack only applies to the next staging of the app",
+			Forward: func() error {
+				return appRepo.AssignTargetStack(ctx, appGuid, newStackName)
+			},
+		},
+		Step{
+			Name:        "restage",
+			Description: fmt.Sprintf("restage app %s on stack %s, with downtime", appName, newStackName),
+			Rationale:   "restaging rebuilds the droplet on the new stack, the app being down meanwhile",
+			Forward: func() error {
+				appRepo.printf("\n")
+				return appRepo.RestageApplication(appName)
+			},
+			Reverse: func() error {
+				err := appRepo.AssignTargetStack(ctx, appGuid, oldStackName)
+				if err != nil {
+					return err
+				}
+				return appRepo.RestageApplication(appName)
+			},
+		},
+	)
+	return plan
+}
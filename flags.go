@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const configFileName = ".cf-bg-change-stack.json"
+
+// parseFlags parses the flags of a command and returns its positional
+// arguments. Unlike flag.FlagSet.Parse it doesn't stop at the first
+// positional argument, so flags may follow the app name as is usual with cf.
+// The defaults of the flags are first taken from the config file, if any.
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	err := applyConfigFile(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	var positional []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// applyConfigFile sets the flags named by the keys of the config file in the
+// home dir to their values there, e.g. {"keep-venerable": true}. The file is
+// shared by all the commands, so keys naming a flag the command doesn't have
+// are ignored.
+func applyConfigFile(flags *flag.FlagSet) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	path := filepath.Join(home, configFileName)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	err = json.Unmarshal(content, &values)
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flags.Lookup(name) == nil {
+			continue
+		}
+		err := flags.Set(name, configValue(values[name]))
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: option '%s': %s", path, name, err)
+		}
+	}
+	return nil
+}
+
+// configValue returns the value of a key of the config file as given on the
+// command line. Numbers are written out in full, as fmt would write 1000000
+// as 1e+06, which the flags don't parse.
+func configValue(value interface{}) string {
+	if number, ok := value.(float64); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+var stackNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// validateChangeStackArgs checks the app and stack names given on the command
+// line are well formed, before anything is run.
+func validateChangeStackArgs(appNames []string, stackName string) error {
+	for _, appName := range appNames {
+		if strings.TrimSpace(appName) == "" {
+			return fmt.Errorf("app names can't be empty")
+		}
+		// Names are passed to cf as arguments, which would take this one for
+		// an option.
+		if strings.HasPrefix(appName, "-") {
+			return fmt.Errorf("app name '%s' starts with '-', which cf would take for an option", appName)
+		}
+		if len(appName) > maxAppNameLength {
+			return fmt.Errorf("app name '%s' is longer than %d characters", appName, maxAppNameLength)
+		}
+	}
+	if !stackNamePattern.MatchString(stackName) {
+		return fmt.Errorf("invalid stack name '%s', expected letters, digits, '.', '_' or '-' only", stackName)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateChangeStackArgsAcceptsNamesUpToCFLimit(t *testing.T) {
+	for _, length := range []int{1, 64, maxAppNameLength} {
+		err := validateChangeStackArgs([]string{strings.Repeat("a", length)}, "cflinuxfs4")
+		if err != nil {
+			t.Errorf("a %d characters app name was rejected: %s", length, err)
+		}
+	}
+	err := validateChangeStackArgs([]string{strings.Repeat("a", maxAppNameLength+1)}, "cflinuxfs4")
+	if err == nil {
+		t.Errorf("a %d characters app name was accepted", maxAppNameLength+1)
+	}
+}
+
+func TestConfigFileKeepsLargeNumbers(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	err := ioutil.WriteFile(filepath.Join(home, configFileName), []byte(`{"drain": 1000000, "parallel": 4}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := flag.NewFlagSet("bg-change-stack", flag.ContinueOnError)
+	options := changeStackFlags(flags)
+	batchFlags(flags, options)
+	_, err = parseFlags(flags, []string{"app", "cflinuxfs4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Drain != 1000000 {
+		t.Errorf("drain = %d, want 1000000", options.Drain)
+	}
+	if options.Parallel != 4 {
+		t.Errorf("parallel = %d, want 4", options.Parallel)
+	}
+}
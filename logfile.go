@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin"
+)
+
+// The levels of the lines of the log file.
+const (
+	logDebug = "DEBUG"
+	logInfo  = "INFO"
+	logError = "ERROR"
+)
+
+// runLog records what the plugin does in a file, each line telling its time,
+// level, the run it belongs to and the app it is about, so the migrations of
+// a fleet can be reconstructed.
+type runLog struct {
+	logger *log.Logger
+	runID  string
+}
+
+// activeLog is the log of the run, nil unless --log-file is passed.
+var activeLog *runLog
+
+// openRunLog appends the log of the run to the file at the given path until
+// the plugin exits.
+func openRunLog(path string, args []string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	atExit(func() { f.Close() })
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	activeLog = &runLog{logger: log.New(f, "", 0), runID: hex.EncodeToString(id)}
+	logf(logInfo, "", "started: cf %s", strings.Join(args, " "))
+	return nil
+}
+
+// logf writes a line about the app, if any, to the log file.
+func logf(level, appName, format string, args ...interface{}) {
+	if activeLog == nil {
+		return
+	}
+	activeLog.logger.Printf("%s %-5s run=%s app=%s %s", time.Now().UTC().Format(time.RFC3339), level, activeLog.runID, appName, fmt.Sprintf(format, args...))
+}
+
+// logEvent writes a progress event to the log file.
+func logEvent(event progressEvent) {
+	switch {
+	case event.Step != "" && event.Error != "":
+		logf(logError, event.App, "step %s %s: %s", event.Step, event.Status, event.Error)
+	case event.Step != "":
+		logf(logInfo, event.App, "step %s %s", event.Step, event.Status)
+	case event.Error != "":
+		logf(logError, event.App, "stack change %s: %s", event.Status, event.Error)
+	case event.Message != "":
+		logf(logInfo, event.App, "stack change %s: %s", event.Status, event.Message)
+	default:
+		logf(logInfo, event.App, "stack change %s", event.Status)
+	}
+}
+
+// loggingConnection writes each cf command run for the app to the log file,
+// along with its error if it fails.
+type loggingConnection struct {
+	plugin.CliConnection
+	appName string
+}
+
+func (conn loggingConnection) CliCommand(args ...string) ([]string, error) {
+	logf(logDebug, conn.appName, "$ cf %s", formatCommand(args))
+	output, err := conn.CliConnection.CliCommand(args...)
+	conn.logError(args, err)
+	return output, err
+}
+
+func (conn loggingConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	logf(logDebug, conn.appName, "$ cf %s", formatCommand(args))
+	output, err := conn.CliConnection.CliCommandWithoutTerminalOutput(args...)
+	conn.logError(args, err)
+	return output, err
+}
+
+func (conn loggingConnection) logError(args []string, err error) {
+	if err != nil {
+		logf(logError, conn.appName, "cf %s failed: %s", args[0], err)
+	}
+}
@@ -1,23 +1,37 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/cli/plugin"
-	"github.com/contraband/autopilot/rewind"
 )
 
 type BgChangeStackPlugin struct{}
+
+// Job is a job of the v2 API, or of the v3 API once normalized, whose fields
+// are then set in the v2 ones as well.
 type Job struct {
-	Metadata struct {
+	GUID      string     `json:"guid"`
+	State     string     `json:"state"`
+	CreatedAt time.Time  `json:"created_at"`
+	Errors    []APIError `json:"errors"`
+	Metadata  struct {
 		GUID      string    `json:"guid"`
 		CreatedAt time.Time `json:"created_at"`
 		URL       string    `json:"url"`
@@ -34,40 +48,163 @@ type Job struct {
 	} `json:"entity"`
 }
 
-func venerableAppName(appName string) string {
-	return fmt.Sprintf("%s-venerable", appName)
+// APIError is an error reported by the v3 API.
+type APIError struct {
+	Code   int    `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func (e APIError) Error() string {
+	return fmt.Sprintf("%s: %s [code: %d]", e.Title, e.Detail, e.Code)
+}
+
+// v3JobStatuses maps the states of v3 jobs to the statuses of v2 ones.
+var v3JobStatuses = map[string]string{
+	"PROCESSING": "running",
+	"POLLING":    "running",
+	"COMPLETE":   "finished",
+	"FAILED":     "failed",
+}
+
+func (job *Job) normalize() {
+	job.Entity.GUID = job.GUID
+	job.Entity.Status = v3JobStatuses[job.State]
+	job.Metadata.GUID = job.GUID
+	job.Metadata.CreatedAt = job.CreatedAt
+}
+
+// Failure describes why a failed job failed.
+func (job Job) Failure() error {
+	if len(job.Errors) > 0 {
+		return job.Errors[0]
+	}
+	details := job.Entity.ErrorDetails
+	if details.Description == "" && details.ErrorCode == "" {
+		return fmt.Errorf("job %s failed: %s", job.Entity.GUID, job.Entity.Error)
+	}
+	return fmt.Errorf("Error %s, %s [code: %d]", details.ErrorCode, details.Description, details.Code)
+}
+
+const (
+	defaultVenerableSuffix = "-venerable"
+	// maxAppNameLength is the length beyond which the Cloud Controller
+	// rejects app names.
+	maxAppNameLength = 255
+)
+
+func venerableAppName(appName, suffix string) string {
+	return appName + suffix
 }
-func changeStackActions(appRepo *ApplicationRepo, appName string, newStackName string) []rewind.Action {
-	return []rewind.Action{
-		// create manifest
-		{
+
+// changeStackActions returns the plan of the blue-green stack change of the
+// app. The services bound and routes mapped to the new app are recorded in
+// the state, so they are released by a rollback after the stack change is
+// resumed as well.
+func changeStackActions(ctx context.Context, appRepo *ApplicationRepo, appName string, newStackName string, options changeStackOptions, state *StateFile) Plan {
+	venerableName := venerableAppName(appName, options.VenerableSuffix)
+
+	// If the new app cannot start we'll have a lingering application.
+	// We delete this application so that the rename can succeed. Releasing
+	// its services and routes first makes them stop reaching it even if it
+	// can't be deleted.
+	restoreVenerable := func() error {
+		releaseNewApp(appRepo, appName, *state)
+		return restoreVenerableApp(appRepo, appName, venerableName)
+	}
+
+	// Returns the GUIDs of the old and new apps.
+	appGuids := func() (string, string, error) {
+		oldAppGuid, err := appRepo.GetAppGuid(venerableName)
+		if err != nil {
+			return "", "", err
+		}
+		newAppGuid, err := appRepo.GetAppGuid(appName)
+		return oldAppGuid, newAppGuid, err
+	}
+
+	// Once the stack of the new app was changed, it is first put back on the
+	// stack of the old app, so it isn't left half migrated if it can't be
+	// deleted.
+	restoreStackAndVenerable := func() error {
+		oldAppGuid, newAppGuid, err := appGuids()
+		if err == nil {
+			var oldApp App
+			oldApp, err = appRepo.GetApp(oldAppGuid)
+			if err == nil {
+				err = appRepo.AssignTargetStack(ctx, newAppGuid, oldApp.Lifecycle.Data.Stack)
+			}
+		}
+		if err != nil {
+			appRepo.printf("warning: failed to put app %s back on its old stack: %s\n", appName, err)
+		}
+		return restoreVenerable()
+	}
+
+	plan := Plan{
+		RewindFailureMessage: "Oh no. Something's gone wrong. I've tried to roll back but you should check to see if everything is OK.",
+		CutoverStep:          "push",
+	}
+	plan.Add(
+		Step{
+			Name:        "create_manifest",
+			Description: fmt.Sprintf("create the manifest of app %s", appName),
+			Rationale:   "the new app is pushed with the configuration of the old one, as captured by its manifest",
 			Forward: func() error {
 				return appRepo.CreateManifest(appName)
 			},
 		},
-		// create fake file to deploy
-		{
+		Step{
+			Name:        "pin_buildpacks",
+			Description: fmt.Sprintf("name the buildpacks of app %s in its manifest", appName),
+			Rationale:   "the new app would otherwise detect its buildpacks again, possibly picking others",
+			Forward: func() error {
+				return appRepo.PinBuildpacks(appName, newStackName)
+			},
+		},
+		Step{
+			Name:        "check_manifest",
+			State:       StateCaptured,
+			Description: "check the manifest captured the configuration of the app",
+			Rationale:   "a manifest without configuration would rebuild the app with default settings",
+			Forward: func() error {
+				return appRepo.CheckManifestNotBlank(appName)
+			},
+		},
+		Step{
+			Name:        "touch_dir",
+			Description: "create a fake file to push",
+			Rationale:   "cf push needs something to upload, the real bits are copied from the old app afterwards",
 			Forward: func() error {
 				return appRepo.TouchDir()
 			},
 		},
-		// rename
-		{
+		Step{
+			Name:        "rename",
+			State:       StateRenamed,
+			Description: fmt.Sprintf("rename app %s to %s", appName, venerableName),
+			Rationale:   "the old app keeps serving its routes under another name while the new app is built",
 			Forward: func() error {
-				return appRepo.RenameApplication(appName, venerableAppName(appName))
+				return appRepo.RenameApplication(appName, venerableName)
 			},
 		},
-		// push
-		{
+		Step{
+			Name:        "push",
+			State:       StatePushed,
+			Description: fmt.Sprintf("push app %s without starting it", appName),
+			Rationale:   "creating the new app with a push is the only way a plugin can give it the configuration of the manifest",
 			Forward: func() error {
-				appRepo.PushApplication(appName)
-				return nil
+				return appRepo.PushApplication(appName)
 			},
+			Reverse: restoreVenerable,
 		},
-		// Copy bits
-		{
+		Step{
+			Name:        "copy_bits",
+			State:       StateCopied,
+			Description: fmt.Sprintf("copy the bits of app %s to app %s", venerableName, appName),
+			Rationale:   "the new app must run the same code as the old one, without having the source code at hand",
 			Forward: func() error {
-				oldAppGuid, err := appRepo.GetAppGuid(venerableAppName(appName))
+				oldAppGuid, err := appRepo.GetAppGuid(venerableName)
 				if err != nil {
 					return err
 				}
@@ -75,139 +212,1174 @@ func changeStackActions(appRepo *ApplicationRepo, appName string, newStackName s
 				if err != nil {
 					return err
 				}
-				job, err := appRepo.CopyBits(oldAppGuid, newAppGuid)
-				if err != nil {
-					return err
-				}
-				for {
-					job, err := appRepo.GetJob(job.Entity.GUID)
+				if options.SkipCopyIfPresent {
+					present, err := appRepo.HasBitsOf(newAppGuid, oldAppGuid)
 					if err != nil {
 						return err
 					}
-					if job.Entity.Status == "finished" {
+					if present {
+						appRepo.printf("new app already has the bits of the old app, skipping copy\n")
 						return nil
 					}
-					if job.Entity.Status == "failed" {
-						return fmt.Errorf(
-							"Error %s, %s [code: %d]",
-							job.Entity.ErrorDetails.ErrorCode,
-							job.Entity.ErrorDetails.Description,
-							job.Entity.ErrorDetails.Code,
-						)
-					}
 				}
-				return nil
+				return copyBits(ctx, appRepo, oldAppGuid, newAppGuid, appName, options)
 			},
-			ReversePrevious: func() error {
-				// If the app cannot start we'll have a lingering application
-				// We delete this application so that the rename can succeed
-				appRepo.DeleteApplication(appName)
-
-				return appRepo.RenameApplication(venerableAppName(appName), appName)
+			Reverse: restoreVenerable,
+		},
+		Step{
+			Name:        "copy_health_checks",
+			Description: fmt.Sprintf("give the processes of app %s the health checks of app %s", appName, venerableName),
+			Rationale:   "the push may reset health checks, which would make the new app look unhealthy",
+			Forward: func() error {
+				oldAppGuid, err := appRepo.GetAppGuid(venerableName)
+				if err != nil {
+					return err
+				}
+				newAppGuid, err := appRepo.GetAppGuid(appName)
+				if err != nil {
+					return err
+				}
+				err = appRepo.CopyHealthChecks(oldAppGuid, newAppGuid)
+				if err != nil {
+					return err
+				}
+				if options.HealthCheckType != "" {
+					err = appRepo.SetHealthCheckType(appName, options.HealthCheckType)
+					if err != nil {
+						return err
+					}
+				}
+				if options.AppStartTimeout == 0 {
+					return nil
+				}
+				return appRepo.SetStartTimeout(newAppGuid, options.AppStartTimeout)
 			},
+			Reverse: restoreVenerable,
 		},
-		// restart
-		{
+		Step{
+			Name:        "copy_commands",
+			Description: fmt.Sprintf("give the processes of app %s the start commands of app %s", appName, venerableName),
+			Rationale:   "a start command set with cf push -c may be missing from the manifest",
 			Forward: func() error {
-				fmt.Println()
-				return appRepo.RestartApplication(appName)
+				oldAppGuid, newAppGuid, err := appGuids()
+				if err != nil {
+					return err
+				}
+				err = appRepo.CopyCommands(oldAppGuid, newAppGuid)
+				if err != nil || options.StartCommand == "" {
+					return err
+				}
+				return appRepo.SetProcessCommand(newAppGuid, "web", options.StartCommand)
 			},
-			ReversePrevious: func() error {
-				// If the app cannot start we'll have a lingering application
-				// We delete this application so that the rename can succeed
-				appRepo.DeleteApplication(appName)
-
-				return appRepo.RenameApplication(venerableAppName(appName), appName)
+			Reverse: restoreVenerable,
+		},
+	)
+	plan.AddIf(options.Preserved[preserveEnv], Step{
+		Name:        "preserve_env",
+		Description: fmt.Sprintf("give app %s the environment variables of app %s", appName, venerableName),
+		Rationale:   "variables set with cf set-env may be missing from the manifest",
+		Forward: func() error {
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			return appRepo.CopyEnv(oldAppGuid, newAppGuid)
+		},
+		Reverse: restoreVenerable,
+	})
+	plan.AddIf(options.Preserved[preserveServices], Step{
+		Name:        "preserve_services",
+		Description: fmt.Sprintf("bind app %s to the services of app %s", appName, venerableName),
+		Rationale:   "services bound outside of the manifest would be missing from the new app",
+		Forward: func() error {
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			state.BoundServices, err = appRepo.BindServices(oldAppGuid, newAppGuid, appName)
+			return err
+		},
+		Reverse: restoreVenerable,
+	})
+	plan.AddIf(options.Preserved[preserveFeatures], Step{
+		Name:        "preserve_features",
+		Description: fmt.Sprintf("enable the app features of app %s on app %s", venerableName, appName),
+		Rationale:   "app features such as ssh aren't captured by the manifest",
+		Forward: func() error {
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			return appRepo.CopyFeatures(oldAppGuid, newAppGuid)
+		},
+		Reverse: restoreVenerable,
+	})
+	plan.AddIf(options.Preserved[preserveMetadata], Step{
+		Name:        "preserve_metadata",
+		Description: fmt.Sprintf("set the labels and annotations of app %s on app %s", venerableName, appName),
+		Rationale:   "labels and annotations used by operators and automation aren't captured by the manifest",
+		Forward: func() error {
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			return appRepo.CopyMetadata(oldAppGuid, newAppGuid)
+		},
+		Reverse: restoreVenerable,
+	})
+	plan.AddIf(options.Preserved[preserveSidecars], Step{
+		Name:        "preserve_sidecars",
+		Description: fmt.Sprintf("create the sidecars of app %s on app %s", venerableName, appName),
+		Rationale:   "sidecars created through the API aren't captured by the manifest, the new app would run without them",
+		Forward: func() error {
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			return appRepo.CopySidecars(oldAppGuid, newAppGuid)
+		},
+		Reverse: restoreVenerable,
+	})
+	plan.AddIf(options.Preserved[preserveRoutes], Step{
+		Name:        "map_routes",
+		Description: fmt.Sprintf("map the routes of app %s to app %s", venerableName, appName),
+		Rationale:   "routes mapped outside of the manifest, or on domains it can't describe, would be lost with the old app",
+		Forward: func() error {
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			state.MappedRoutes, err = appRepo.CopyRoutes(oldAppGuid, newAppGuid)
+			return err
+		},
+		Reverse: restoreVenerable,
+	})
+	plan.Add(
+		Step{
+			Name:        "restart",
+			State:       StateCopied,
+			Description: fmt.Sprintf("restart app %s with the copied bits", appName),
+			Rationale:   "staging the copied bits and starting the new app puts it on the routes alongside the old app",
+			Forward: func() error {
+				appRepo.printf("\n")
+				return appRepo.StartWithRetries(ctx, appName, options.StartRetries, options.StartTimeout, appRepo.RestartApplication)
 			},
+			Reverse: restoreVenerable,
 		},
-		// change-stack
-		{
+		Step{
+			Name:        "change_stack",
+			State:       StateAssigned,
+			Description: fmt.Sprintf("change the stack of app %s to %s", appName, newStackName),
+			Rationale:   "the stack only applies to the next staging of the app",
 			Forward: func() error {
-				fmt.Println()
+				appRepo.printf("\n")
 				newAppGuid, err := appRepo.GetAppGuid(appName)
 				if err != nil {
 					return err
 				}
 
-				return appRepo.AssignTargetStack(newAppGuid, newStackName)
+				return appRepo.AssignTargetStack(ctx, newAppGuid, newStackName)
 			},
+			Reverse: restoreStackAndVenerable,
 		},
 		// Restage again for stack change to take effect
-		{
+		Step{
+			Name:        "restage",
+			State:       StateRestaged,
+			Description: fmt.Sprintf("restage app %s on stack %s", appName, newStackName),
+			Rationale:   "restaging a second time rebuilds the droplet on the new stack, the old app serving traffic if it fails",
 			Forward: func() error {
-				fmt.Println()
-				return appRepo.RestageApplication(appName)
+				appRepo.printf("\n")
+				return appRepo.StartWithRetries(ctx, appName, options.StartRetries, options.StartTimeout, appRepo.RestageApplication)
 			},
-			ReversePrevious: func() error {
-				// If the app cannot start with new stack, we'll have a lingering application
-				// We delete this application so that the rename can succeed
-				appRepo.DeleteApplication(appName)
-
-				return appRepo.RenameApplication(venerableAppName(appName), appName)
+			Reverse: restoreStackAndVenerable,
+		},
+	)
+	var oldProcesses []Process
+	captureScale := func() error {
+		oldAppGuid, err := appRepo.GetAppGuid(venerableName)
+		if err != nil {
+			return err
+		}
+		oldProcesses, err = appRepo.GetProcesses(oldAppGuid)
+		return err
+	}
+	if options.Preserved[preserveScale] {
+		plan.InsertBefore("push", Step{
+			Name:        "capture_scale",
+			Description: fmt.Sprintf("read the scale of app %s", venerableName),
+			Rationale:   "scaling applied with cf scale after the last push may be missing from the manifest, for each process",
+			Forward:     captureScale,
+			Reverse:     restoreVenerable,
+		})
+		// Scaling the new app before it starts avoids running it with fewer
+		// instances than the old one during the cutover.
+		plan.InsertBefore("restart", Step{
+			Name:        "preserve_scale",
+			Description: fmt.Sprintf("scale app %s like app %s", appName, venerableName),
+			Rationale:   "the new app must handle the load of the old one",
+			Forward: func() error {
+				// The scale wasn't captured when resuming after the push.
+				if oldProcesses == nil {
+					err := captureScale()
+					if err != nil {
+						return err
+					}
+				}
+				newAppGuid, err := appRepo.GetAppGuid(appName)
+				if err != nil {
+					return err
+				}
+				return appRepo.ScaleProcesses(appName, newAppGuid, oldProcesses, options.MatchInstances)
 			},
+			Reverse: restoreVenerable,
+		})
+	}
+	if options.NoRestart {
+		// Staging the new app on the old stack only served to start it.
+		plan.Replace("restart")
+		plan.Replace("restage", Step{
+			Name:        "stage",
+			State:       StateRestaged,
+			Description: fmt.Sprintf("stage app %s on stack %s without starting it", appName, newStackName),
+			Rationale:   "the app is meant to stay stopped, it only needs a droplet built on the new stack",
+			Forward: func() error {
+				newAppGuid, err := appRepo.GetAppGuid(appName)
+				if err != nil {
+					return err
+				}
+				return appRepo.StageApplication(ctx, newAppGuid)
+			},
+			Reverse: restoreStackAndVenerable,
+		})
+	}
+	if options.Manifest != "" {
+		plan.Replace("create_manifest", Step{
+			Name:        "copy_manifest",
+			Description: fmt.Sprintf("copy manifest %s", options.Manifest),
+			Rationale:   "the new app is pushed with the configuration of the manifest given instead of a generated one",
+			Forward: func() error {
+				return appRepo.UseManifest(options.Manifest, appName)
+			},
+		})
+		// The buildpacks are as the manifest given says.
+		plan.Replace("pin_buildpacks")
+	}
+	if options.DownloadDroplet {
+		plan.Replace("touch_dir")
+		plan.Replace("push", Step{
+			Name:        "push",
+			State:       StatePushed,
+			Description: fmt.Sprintf("push app %s with the droplet of app %s without starting it", appName, venerableName),
+			Rationale:   "the new app first runs the very droplet of the old app, without staging it again on the old stack",
+			Forward: func() error {
+				dropletPath, err := appRepo.DownloadDroplet(venerableName)
+				if err != nil {
+					return err
+				}
+				return appRepo.PushApplicationWithDroplet(appName, dropletPath)
+			},
+			Reverse: restoreVenerable,
+		})
+	}
+	// Left stopped, the new app has no instances to wait for.
+	plan.AddIf(!options.NoRestart, Step{
+		Name:        "wait_running",
+		State:       StateSwapped,
+		Description: fmt.Sprintf("wait for the instances of app %s to be running", appName),
+		Rationale:   "a restage may succeed while the instances then crash, the old app must be kept until the new one runs",
+		Forward: func() error {
+			return appRepo.StartWithRetries(ctx, appName, options.StartRetries, options.StartTimeout, func(appName string) error {
+				return appRepo.WaitForAppRunning(ctx, appName, options.StartTimeout)
+			})
 		},
-		// delete
-		{
+		Reverse: restoreVenerable,
+	})
+	plan.AddIf(options.Preserved[preserveRoutes], Step{
+		Name:        "verify_routes",
+		Description: fmt.Sprintf("check app %s has all the routes of app %s", appName, venerableName),
+		Rationale:   "routes mapped outside of the manifest would be lost with the old app",
+		Forward: func() error {
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			return appRepo.VerifyRoutes(oldAppGuid, newAppGuid)
+		},
+		Reverse: restoreVenerable,
+	})
+	var routeBindings []RouteBinding
+	captureRouteBindings := func() error {
+		oldAppGuid, err := appRepo.GetAppGuid(venerableName)
+		if err != nil {
+			return err
+		}
+		routes, err := appRepo.GetAppRoutes(oldAppGuid)
+		if err != nil {
+			return err
+		}
+		routeBindings, err = appRepo.GetRouteBindings(routes)
+		return err
+	}
+	if options.Preserved[preserveRoutes] {
+		plan.InsertBefore("push", Step{
+			Name:        "capture_route_services",
+			Description: fmt.Sprintf("read the route service bindings of the routes of app %s", venerableName),
+			Rationale:   "route services guarding the routes must still see their requests once the new app serves them",
+			Forward:     captureRouteBindings,
+			Reverse:     restoreVenerable,
+		})
+		plan.Add(Step{
+			Name:        "preserve_route_services",
+			Description: fmt.Sprintf("check the routes of app %s are still bound to their route services", appName),
+			Rationale:   "security or routing middleware bound to the routes must not silently drop off during the cutover",
 			Forward: func() error {
-				return appRepo.DeleteApplication(venerableAppName(appName))
+				// The bindings weren't captured when resuming after the push.
+				if routeBindings == nil {
+					err := captureRouteBindings()
+					if err != nil {
+						return err
+					}
+				}
+				restored, err := appRepo.RestoreRouteBindings(ctx, routeBindings)
+				if restored > 0 {
+					appRepo.printf("bound %d route(s) to their route service again\n", restored)
+				}
+				return err
 			},
+			Reverse: restoreVenerable,
+		})
+	}
+	plan.AddIf(options.SmokeTest != "", Step{
+		Name:        "smoke_test",
+		Description: fmt.Sprintf("run smoke test command against app %s", appName),
+		Rationale:   "the old app can only be brought back until it is deleted, the new app must pass the checks of the team first",
+		Forward: func() error {
+			newAppGuid, err := appRepo.GetAppGuid(appName)
+			if err != nil {
+				return err
+			}
+			routes, err := appRepo.GetAppRoutes(newAppGuid)
+			if err != nil {
+				return err
+			}
+			return runSmokeTest(ctx, appRepo.output(), options.SmokeTest, appName, routeURLs(routes))
+		},
+		Reverse: restoreVenerable,
+	})
+	plan.AddIf(options.HealthCheckType != "", Step{
+		Name:        "restore_health_check",
+		Description: fmt.Sprintf("give app %s the health check type of app %s back", appName, venerableName),
+		Rationale:   "the health check type given for the migration only is replaced by the one the app had",
+		Optional:    true,
+		Forward: func() error {
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			return appRepo.RestoreHealthCheckType(oldAppGuid, newAppGuid)
 		},
+	})
+	plan.AddIf(options.KeepVenerable, Step{
+		Name:        "stop_venerable",
+		State:       StateCleaned,
+		Description: fmt.Sprintf("stop app %s", venerableName),
+		Rationale:   "the stopped old app allows going back to the old stack by hand",
+		Forward: func() error {
+			err := appRepo.StopApplication(venerableName)
+			if err != nil {
+				return fmt.Errorf("app %s may still be running alongside app %s, stop it with `cf stop %s`: %s", venerableName, appName, venerableName, err)
+			}
+			appRepo.printf("app %s was kept stopped, to go back to it run:\n", venerableName)
+			appRepo.printf("  cf start %s && cf delete %s -f && cf rename %s %s\n", venerableName, appName, venerableName, appName)
+			return nil
+		},
+		// The new app already serves the routes, it isn't rolled back
+		// because the old one is still running.
+		Optional: true,
+	})
+	plan.AddIf(options.Preserved[preserveRoutes] && !options.KeepVenerable, Step{
+		Name:        "unmap_venerable_routes",
+		Description: fmt.Sprintf("unmap the routes of app %s", venerableName),
+		Rationale:   "the routes stop reaching the old app before it is deleted, the new app serving them all",
+		Forward: func() error {
+			oldAppGuid, err := appRepo.GetAppGuid(venerableName)
+			if err != nil {
+				return err
+			}
+			routes, err := appRepo.GetAppRoutes(oldAppGuid)
+			if err != nil {
+				return err
+			}
+			_, err = appRepo.UnmapRoutes(routes, oldAppGuid)
+			return err
+		},
+		// Deleting the old app unmaps its routes anyway.
+		Optional: true,
+	})
+	plan.AddIf(options.Drain > 0 && !options.KeepVenerable, Step{
+		Name:        "drain",
+		Description: fmt.Sprintf("stop app %s and wait %ds before deleting it", venerableName, options.Drain),
+		Rationale:   "the connections in flight to the old app get time to finish instead of being cut by its deletion",
+		Forward: func() error {
+			err := appRepo.StopApplication(venerableName)
+			if err != nil {
+				return err
+			}
+			return sleep(ctx, time.Duration(options.Drain)*time.Second)
+		},
+		// The routes of the old app may have been unmapped by then, it gets
+		// those of the new app back before taking its place again.
+		Reverse: func() error {
+			err := appRepo.StartApplication(venerableName)
+			if err != nil {
+				return err
+			}
+			oldAppGuid, newAppGuid, err := appGuids()
+			if err != nil {
+				return err
+			}
+			_, err = appRepo.CopyRoutes(newAppGuid, oldAppGuid)
+			if err != nil {
+				return err
+			}
+			return restoreVenerable()
+		},
+	})
+	plan.AddIf(!options.KeepVenerable,
+		Step{
+			Name:        "delete",
+			State:       StateCleaned,
+			Description: fmt.Sprintf("delete app %s", venerableName),
+			Rationale:   "once the new app runs on the new stack, the old one is no longer needed",
+			Forward: func() error {
+				if options.Interactive && canPrompt() && !confirm(fmt.Sprintf("Delete old app %s?", venerableName)) {
+					appRepo.printf("app %s was kept, delete it with `cf delete %s -f` once you are confident app %s works\n", venerableName, venerableName, appName)
+					return nil
+				}
+				err := appRepo.DeleteApplication(venerableName)
+				if err != nil {
+					return err
+				}
+				err = appRepo.WaitForAppDeleted(ctx, venerableName, options.DeleteVenerableTimeout)
+				if err != nil {
+					appRepo.printf("warning: app %s may still exist: %s\n", venerableName, err)
+				}
+				return nil
+			},
+		},
+	)
+	return plan
+}
+
+const (
+	copyBitsReportInterval = 30 * time.Second
+)
+
+// copyBits copies the bits of the old app to the new app and waits for the copy
+// to finish. Where the copy_bits feature flag is disabled, the package of the
+// old app is downloaded and pushed to the new app instead. The droplet of the
+// old app isn't pushed: it was staged on the old stack, and the new app is
+// restaged on the new stack from its package.
+func copyBits(ctx context.Context, appRepo *ApplicationRepo, oldAppGuid, newAppGuid, newAppName string, options changeStackOptions) error {
+	job, err := appRepo.CopyBits(oldAppGuid, newAppGuid)
+	if isCopyBitsDisabled(err) {
+		appRepo.printf("copying bits is not allowed on this foundation (%s), downloading the package of the old app and pushing it instead\n", err)
+		return appRepo.PushPackageOf(oldAppGuid, newAppName)
+	}
+	if err != nil {
+		return err
 	}
+	return waitForCopyBits(ctx, appRepo, job, options)
 }
+
+// waitForCopyBits polls the copy of the package until it finishes, showing a spinner
+// on terminals and otherwise reporting its progress every
+// copyBitsReportInterval, jobs not telling how much was copied. It gives up when the job outlives
+// appRepo.PollTimeout, or early when it is still queued after
+// options.CopyBitsStartTimeout.
+func waitForCopyBits(ctx context.Context, appRepo *ApplicationRepo, job Job, options changeStackOptions) error {
+	lastReport := time.Now()
+	var progress *spinner
+	// The spinner rewrites lines of the terminal, apps migrated in parallel
+	// print to their own output.
+	if options.Output != jsonOutput && options.Parallel <= 1 && stdoutIsTerminal() {
+		progress = &spinner{}
+		defer progress.Clear()
+	}
+	return pollJob(ctx, job.Entity.GUID, appRepo.GetPackageJob, appRepo.PollTimeout, appRepo.PollInterval, func(job Job, elapsed time.Duration) error {
+		// The job may have been queued long before we started polling it.
+		age := elapsed
+		if !job.Metadata.CreatedAt.IsZero() {
+			age = time.Since(job.Metadata.CreatedAt)
+		}
+		if job.Entity.Status == "queued" && age > options.CopyBitsStartTimeout {
+			return fmt.Errorf("copy-bits job never started: job %s still queued after %s", job.Entity.GUID, age.Round(time.Second))
+		}
+		if progress != nil {
+			progress.Show(fmt.Sprintf("copying bits... job %s (%s elapsed)", job.Entity.Status, elapsed.Round(time.Second)))
+		} else if time.Since(lastReport) >= copyBitsReportInterval {
+			appRepo.printf("copying bits... job %s is %s, %s elapsed (created %s ago)\n", job.Entity.GUID, job.Entity.Status, elapsed.Round(time.Second), age.Round(time.Second))
+			lastReport = time.Now()
+		}
+		return nil
+	})
+}
+
+// rollbackContext returns ctx, or a context which is never done if ctx
+// already is: waits started once the context is done, those of the rollback,
+// are only bounded by their own timeout, as the commands run by
+// watchdogConnection.
+func rollbackContext(ctx context.Context) context.Context {
+	if ctx.Err() != nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// sleep waits for the given duration, or returns the error of the context
+// if it is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// The exit codes of a failed command, telling pipelines whether the app needs
+// to be looked after.
+const (
+	// exitFailed is the exit code of a command which failed without
+	// changing the app, in a step with nothing to roll back, or for any
+	// other reason.
+	exitFailed = 1
+	// exitRolledBack is the exit code of a stack change which failed after
+	// changing the app, which was rolled back.
+	exitRolledBack = 2
+	// exitRollbackFailed is the exit code of a stack change which failed
+	// and left the app halfway, its rollback failing.
+	exitRollbackFailed = 3
+)
+
+const exitCodesUsage = `
+
+EXIT CODES:
+   1 - failed without changing the app, or with nothing to roll back
+   2 - failed and the app was rolled back
+   3 - failed and the rollback failed, the app needs to be looked after`
+
+// exitError is an error telling with which code to exit.
+type exitError struct {
+	error
+	code int
+}
+
+// exitCode returns the code to exit with because of the error.
+func exitCode(err error) int {
+	if err, ok := err.(exitError); ok {
+		return err.code
+	}
+	return exitFailed
+}
+
 func fatalIf(err error) {
 	if err != nil {
-		fmt.Fprintln(os.Stdout, "error:", err)
-		os.Exit(1)
+		printError(err)
+		exit(exitCode(err))
 	}
 }
 func main() {
 	plugin.Start(&BgChangeStackPlugin{})
 }
 
+// cancelOnInterrupt returns a context canceled on the first interrupt, which
+// makes the step running fail and what was done be rolled back. A second
+// interrupt kills the plugin.
+func cancelOnInterrupt(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(interrupts)
+		select {
+		case <-interrupts:
+			fmt.Println("\ninterrupted, rolling back...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// withOverallTimeout returns a context done after the timeout, if any, which
+// interrupts the waits of the step running, making it fail and what was done
+// be rolled back.
+func withOverallTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func (plugin BgChangeStackPlugin) Run(cliConnection plugin.CliConnection, args []string) {
+	ctx, cancel := cancelOnInterrupt(context.Background())
+	defer cancel()
+	defer runCleanups()
+	cliConnection = newSerialConnection(cliConnection)
 
 	switch args[0] {
 	case "bg-change-stack":
+		flags := flag.NewFlagSet("bg-change-stack", flag.ContinueOnError)
+		showVersion := flags.Bool("version", false, "print the version of the plugin")
+		options := changeStackFlags(flags)
+		batchFlags(flags, options)
+		positional, err := parseFlags(flags, args[1:])
+		fatalIf(err)
+		if *showVersion {
+			fmt.Println(versionString())
+			return
+		}
+		fatalIf(options.Validate())
+		if options.Quiet {
+			fatalIf(silenceOutput())
+		}
+		if options.LogFile != "" {
+			fatalIf(openRunLog(options.LogFile, args))
+		}
+		if len(positional) < 2 {
+			fatalIf(fmt.Errorf("Usage: cf bg-change-stack <app name>... <new stack name>"))
+		}
+		appNames, newStackName := positional[:len(positional)-1], positional[len(positional)-1]
+		err = validateChangeStackArgs(appNames, newStackName)
+		if err != nil {
+			fatalIf(fmt.Errorf("%s\nUsage: cf bg-change-stack <app name>... <new stack name>", err))
+		}
+		fatalIf(targetOrgAndSpace(cliConnection, options.Org, options.Space))
+		ctx, cancel := withOverallTimeout(ctx, options.Timeout)
+		defer cancel()
+
+		if len(appNames) > 1 {
+			results := changeStackOfApps(ctx, cliConnection, appNames, newStackName, *options)
+			reportResults(results, *options)
+			return
+		}
+
+		// There is nothing to run in parallel with a single app.
+		options.Parallel = 1
+		err = changeStack(ctx, cliConnection, appNames[0], newStackName, *options, os.Stdout)
+		if err != nil && !isAlreadyOnStack(err) {
+			logf(logError, appNames[0], "error: %s", err)
+		}
+		if isAlreadyOnStack(err) {
+			if options.Output != jsonOutput {
+				fmt.Println(err)
+			}
+			return
+		}
+		if options.Output == jsonOutput {
+			// The outcome was reported as json.
+			if err != nil {
+				exit(exitCode(err))
+			}
+			return
+		}
+		fatalIf(err)
+
+		fmt.Println()
+		fmt.Println("application stack has been changed with no downtime !")
+		fmt.Println()
+	case "bg-change-stack-select":
+		flags := flag.NewFlagSet("bg-change-stack-select", flag.ContinueOnError)
+		labels := flags.String("labels", "", "label selector matching the apps to migrate")
+		options := changeStackFlags(flags)
+		batchFlags(flags, options)
+		positional, err := parseFlags(flags, args[1:])
+		fatalIf(err)
+		fatalIf(options.Validate())
+		if options.Quiet {
+			fatalIf(silenceOutput())
+		}
+		if options.LogFile != "" {
+			fatalIf(openRunLog(options.LogFile, args))
+		}
+		if *labels == "" || len(positional) != 1 {
+			fatalIf(fmt.Errorf("Usage: cf bg-change-stack-select --labels <selector> <new stack name>"))
+		}
+		err = validateChangeStackArgs(nil, positional[0])
+		if err != nil {
+			fatalIf(fmt.Errorf("%s\nUsage: cf bg-change-stack-select --labels <selector> <new stack name>", err))
+		}
+		fatalIf(targetOrgAndSpace(cliConnection, options.Org, options.Space))
+		ctx, cancel := withOverallTimeout(ctx, options.Timeout)
+		defer cancel()
+
 		appRepo, err := NewApplicationRepo(cliConnection)
 		fatalIf(err)
-		defer appRepo.DeleteDir()
-		if len(args) < 3 {
-			fatalIf(fmt.Errorf("Usage: cf bg-change-stack <app name> <new stack name>"))
+		appNames, err := appRepo.GetAppNamesByLabelSelector(*labels)
+		appRepo.DeleteDir()
+		fatalIf(err)
+		if len(appNames) == 0 {
+			fatalIf(fmt.Errorf("no apps in current space match label selector '%s'", *labels))
+		}
+
+		results := changeStackOfApps(ctx, cliConnection, appNames, positional[0], *options)
+		reportResults(results, *options)
+	case "bg-change-stack-rollback":
+		flags := flag.NewFlagSet("bg-change-stack-rollback", flag.ContinueOnError)
+		venerableSuffix := flags.String("venerable-suffix", defaultVenerableSuffix, "suffix the name of the old app was given")
+		positional, err := parseFlags(flags, args[1:])
+		fatalIf(err)
+		if len(positional) != 1 {
+			fatalIf(fmt.Errorf("Usage: cf bg-change-stack-rollback <app name>"))
+		}
+
+		fatalIf(rollbackChangeStack(cliConnection, positional[0], *venerableSuffix))
+		fmt.Printf("app %s has been restored\n", positional[0])
+	case "bg-change-stack-restore":
+		flags := flag.NewFlagSet("bg-change-stack-restore", flag.ContinueOnError)
+		snapshotFile := flags.String("snapshot", "", "snapshot to restore the configuration of the app from")
+		positional, err := parseFlags(flags, args[1:])
+		fatalIf(err)
+		if len(positional) != 1 || *snapshotFile == "" {
+			fatalIf(fmt.Errorf("Usage: cf bg-change-stack-restore <app name> --snapshot <snapshot file>"))
+		}
+
+		snapshot, err := ReadSnapshot(*snapshotFile)
+		fatalIf(err)
+		fatalIf(restoreSnapshot(ctx, cliConnection, positional[0], snapshot))
+		fmt.Printf("app %s has been restored from snapshot %s\n", positional[0], *snapshotFile)
+	case "bg-validate-snapshot":
+		if len(args) < 2 {
+			fatalIf(fmt.Errorf("Usage: cf bg-validate-snapshot <snapshot file>"))
 		}
 
-		if args[0] == "bg-change-stack" {
-			appName := args[1]
-			actionList := changeStackActions(appRepo, appName, args[2])
-			actions := rewind.Actions{
-				Actions:              actionList,
-				RewindFailureMessage: "Oh no. Something's gone wrong. I've tried to roll back but you should check to see if everything is OK.",
+		snapshot, err := ReadSnapshot(args[1])
+		fatalIf(err)
+		problems := snapshot.Validate()
+		if len(problems) > 0 {
+			fmt.Printf("snapshot of app %s can't be migrated safely:\n", snapshot.AppName)
+			for _, problem := range problems {
+				fmt.Println("  -", problem)
 			}
-			err = actions.Execute()
-			fatalIf(err)
+			os.Exit(1)
+		}
+		fmt.Printf("snapshot of app %s is complete, its stack can be changed\n", snapshot.AppName)
+	case "bg-change-stack-audit":
+		flags := flag.NewFlagSet("bg-change-stack-audit", flag.ContinueOnError)
+		allSpaces := flags.Bool("all-spaces", false, "audit the apps of every space of the current org")
+		positional, err := parseFlags(flags, args[1:])
+		fatalIf(err)
+		if len(positional) != 1 {
+			fatalIf(fmt.Errorf("Usage: cf bg-change-stack-audit <target stack> [--all-spaces]"))
+		}
 
-			fmt.Println()
-			fmt.Println("application stack has been changed with no downtime !")
-			fmt.Println()
+		org, err := cliConnection.GetCurrentOrg()
+		fatalIf(err)
+		space, err := cliConnection.GetCurrentSpace()
+		fatalIf(err)
+		spaceGuid := space.Guid
+		if *allSpaces {
+			spaceGuid = ""
 		}
+		appRepo, err := NewApplicationRepo(cliConnection)
+		fatalIf(err)
+		apps, err := appRepo.GetAppStacks(org.Guid, spaceGuid)
+		appRepo.DeleteDir()
+		fatalIf(err)
+		printAudit(apps, positional[0], *allSpaces)
+	case "bg-change-stack-check":
+		flags := flag.NewFlagSet("bg-change-stack-check", flag.ContinueOnError)
+		venerableSuffix := flags.String("venerable-suffix", defaultVenerableSuffix, "suffix to give to the name of the old app")
+		positional, err := parseFlags(flags, args[1:])
+		fatalIf(err)
+		if len(positional) != 1 {
+			fatalIf(fmt.Errorf("Usage: cf bg-change-stack-check <app name>"))
+		}
+
+		appRepo, err := NewApplicationRepo(cliConnection)
+		fatalIf(err)
+		failed, err := checkReadiness(appRepo, positional[0], *venerableSuffix)
+		appRepo.DeleteDir()
+		fatalIf(err)
+		if failed > 0 {
+			fatalIf(fmt.Errorf("app %s is not ready for its stack to be changed, %d check(s) failed", positional[0], failed))
+		}
+		fmt.Printf("app %s is ready for its stack to be changed\n", positional[0])
+	case "bg-stats":
+		stats, err := ReadUsageStats()
+		fatalIf(err)
+		path, err := statsFilePath()
+		fatalIf(err)
+
+		fmt.Printf("migrations run: %d (%d succeeded, %d failed)\n", stats.Migrations, stats.Succeeded, stats.Failed)
+		if !stats.LastRun.IsZero() {
+			fmt.Printf("last run: %s\n", stats.LastRun.Format(time.RFC1123))
+		}
+		fmt.Printf("stats are only stored locally in %s, set %s or pass --no-telemetry to stop recording them\n", path, noTelemetryEnv)
 	case "CLI-MESSAGE-UNINSTALL":
 		os.Exit(0)
 	}
 }
 
+// changeStack performs the blue-green stack change of a single app, rolling
+// back whatever was done so far if a step fails. Its progress and warnings
+// are printed to out.
+func changeStack(ctx context.Context, cliConnection plugin.CliConnection, appName string, newStackName string, options changeStackOptions, out io.Writer) error {
+	if options.Output == jsonOutput || options.Quiet || options.Parallel > 1 {
+		cliConnection = quietConnection{cliConnection}
+	}
+	if options.Verbose {
+		cliConnection = verboseConnection{cliConnection, appName}
+	}
+	if activeLog != nil {
+		cliConnection = loggingConnection{cliConnection, appName}
+	}
+	conn := newWatchdogConnection(ctx, cliConnection, options.CommandWarnAfter, options.CommandTimeout)
+	conn.Output = out
+	appRepo, err := NewApplicationRepoIn(conn, options.TmpDir)
+	if err != nil {
+		return err
+	}
+	defer appRepo.DeleteDir()
+	appRepo.ctx, appRepo.out = ctx, out
+	if options.MaxCopyBitsWait > 0 {
+		appRepo.PollTimeout = options.MaxCopyBitsWait
+	}
+
+	statePath, err := appRepo.stateFilePath(appName)
+	if err != nil {
+		return err
+	}
+	state, err := LoadStateFile(statePath)
+	if err != nil {
+		return err
+	}
+	reporter := newProgressReporter(appName, options)
+	switch {
+	case state == nil && (options.Resume || options.Rollback):
+		return fmt.Errorf("no interrupted stack change of app '%s' to resume or roll back", appName)
+	case state != nil && options.Rollback:
+		err = rollbackInterrupted(appRepo, appName, *state)
+		if err != nil {
+			return err
+		}
+		return os.Remove(statePath)
+	case state != nil && !options.Resume:
+		return fmt.Errorf(
+			"a previous stack change of app '%s' was interrupted in state %s, run again with --resume to continue it or with --rollback to revert it",
+			appName, state.State,
+		)
+	case state != nil && state.Stack != newStackName:
+		return fmt.Errorf("the interrupted stack change of app '%s' was to stack '%s', not '%s'", appName, state.Stack, newStackName)
+	case state != nil && state.VenerableName != venerableAppName(appName, options.VenerableSuffix):
+		return fmt.Errorf("the interrupted stack change of app '%s' renamed it to '%s', pass the same --venerable-suffix", appName, state.VenerableName)
+	case state == nil:
+		err = runPreflight(appRepo, appName, newStackName, options)
+		if isAlreadyOnStack(err) {
+			reporter.Skipped(err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		state = &StateFile{AppName: appName, VenerableName: venerableAppName(appName, options.VenerableSuffix), Stack: newStackName}
+		oldAppGuid, err := appRepo.GetAppGuid(appName)
+		if err != nil {
+			return err
+		}
+		oldApp, err := appRepo.GetApp(oldAppGuid)
+		if err != nil {
+			return err
+		}
+		state.OldStack, state.OldAppGUID = oldApp.Lifecycle.Data.Stack, oldApp.GUID
+	}
+
+	plan := changeStackActions(ctx, appRepo, appName, newStackName, options, state)
+	switch {
+	case options.Fast:
+		appRepo.printf("warning: app %s will be down while it restages on stack %s\n", appName, newStackName)
+		plan = fastChangeStackActions(ctx, appRepo, appName, newStackName)
+	case options.PreserveGUID:
+		plan = preserveGUIDChangeStackActions(ctx, appRepo, appName, newStackName, options)
+	case options.Strategy == dropletStrategy:
+		plan = dropletChangeStackActions(ctx, appRepo, appName, newStackName, options, state)
+	}
+	if options.Snapshot != "" && len(plan.Steps) > 0 {
+		plan.InsertBefore(plan.Steps[0].Name, Step{
+			Name:        "snapshot",
+			Description: fmt.Sprintf("write the configuration of app %s to %s", appName, appFilePath(options.Snapshot, appName)),
+			Rationale:   "the configuration of the old app is recorded before anything is changed, for audit or to restore it",
+			Forward: func() error {
+				appGuid, err := appRepo.GetAppGuid(appName)
+				if err != nil {
+					return err
+				}
+				snapshot, err := appRepo.CaptureSnapshot(appGuid)
+				if err != nil {
+					return err
+				}
+				return snapshot.Write(appFilePath(options.Snapshot, appName))
+			},
+		})
+	}
+	if state.Step != "" {
+		appRepo.printf("resuming stack change of app %s from state %s\n", appName, state.State)
+		err = appRepo.WriteManifest(state.Manifest)
+		if err != nil {
+			return err
+		}
+		err = plan.SkipThrough(state.Step)
+		if err != nil {
+			return err
+		}
+	}
+	plan.Explain = options.Explain
+	plan.Output = out
+	plan.StepFailed = reporter.StepFailed
+	plan.StepDone = func(step Step) {
+		reporter.StepCompleted(step)
+		if step.State == "" {
+			return
+		}
+		if state.Manifest == "" {
+			state.Manifest, _ = appRepo.ManifestContent()
+		}
+		state.State, state.Step, state.UpdatedAt = step.State, step.Name, time.Now()
+		err := state.Save(statePath)
+		if err != nil {
+			appRepo.printf("warning: failed to save state of the stack change, it won't be resumable: %s\n", err)
+		}
+	}
+	probe := &RouteProbe{Interval: options.ProbeInterval, Deadline: options.ProbeDeadline}
+	if options.Probe {
+		plan.InsertBefore(plan.CutoverStep, Step{
+			Name:        "start_probe",
+			Description: fmt.Sprintf("start probing the routes of app %s", appName),
+			Rationale:   "probing the routes during the cutover gives evidence the app stayed available",
+			Forward: func() error {
+				// The app may have been renamed by then.
+				appGuid, err := appRepo.GetAppGuid(appName)
+				if err != nil {
+					appGuid, err = appRepo.GetAppGuid(venerableAppName(appName, options.VenerableSuffix))
+				}
+				if err != nil {
+					return err
+				}
+				routes, err := appRepo.GetAppRoutes(appGuid)
+				if err != nil {
+					return err
+				}
+				urls, err := appRepo.ProbeURLs(routes)
+				if err != nil {
+					return err
+				}
+				if len(urls) < len(routes) {
+					appRepo.printf("probing %d of the %d routes of app %s, TCP routes and routes on internal domains can't be probed\n", len(urls), len(routes), appName)
+				}
+				probe.Start(urls)
+				return nil
+			},
+			Optional: true,
+		})
+	}
+
+	if options.DryRun {
+		appRepo.printf("\nthe stack of app %s would be changed to %s in these steps:\n", appName, newStackName)
+		for i, description := range plan.Descriptions() {
+			appRepo.printf("%3d. %s\n", i+1, description)
+		}
+		if options.Fast || options.PreserveGUID || options.Strategy == dropletStrategy {
+			return nil
+		}
+		return dryRun(appRepo, appName, options.Manifest)
+	}
+
+	if options.Probe {
+		defer func() {
+			appRepo.printf("route probe: %s\n", probe.Stop())
+		}()
+	}
+	start := time.Now()
+	err = plan.Execute(ctx)
+	reporter.Finished(err, plan.RolledBack())
+	if err == nil && options.Output != jsonOutput {
+		printChangeSummary(appRepo, *state, time.Since(start))
+	}
+	if options.Timings && options.Output != jsonOutput {
+		printTimings(out, plan.Timings)
+	}
+	if err == nil || plan.RolledBack() {
+		os.Remove(statePath)
+	} else if state.State != "" {
+		appRepo.printf("the stack change stopped in state %s, run again with --resume to continue it or with --rollback to revert it\n", state.State)
+	}
+	if telemetryEnabled(options) {
+		// Failing to count the migration must not fail the migration.
+		RecordMigration(err)
+	}
+	if err == nil && options.ResultFile != "" {
+		resultErr := writeResult(appRepo, appName, newStackName, appFilePath(options.ResultFile, appName))
+		if resultErr != nil {
+			return fmt.Errorf("the stack of app %s was changed but its result file couldn't be written: %s", appName, resultErr)
+		}
+	}
+	switch {
+	case err != nil && plan.RolledBack():
+		err = exitError{err, exitRolledBack}
+	case err != nil && plan.RollbackAttempted():
+		err = exitError{err, exitRollbackFailed}
+	}
+	return err
+}
+
+// printChangeSummary prints what changed, for the record.
+func printChangeSummary(appRepo *ApplicationRepo, state StateFile, elapsed time.Duration) {
+	newAppGuid, err := appRepo.GetAppGuid(state.AppName)
+	if err != nil {
+		newAppGuid = "unknown"
+	}
+	oldStack, oldAppGuid := state.OldStack, state.OldAppGUID
+	if oldStack == "" {
+		// Saved before the old stack was recorded.
+		oldStack, oldAppGuid = "unknown", "unknown"
+	}
+
+	appRepo.printf("\n")
+	appRepo.printf("app:       %s\n", state.AppName)
+	appRepo.printf("old stack: %s (app GUID %s)\n", oldStack, oldAppGuid)
+	appRepo.printf("new stack: %s (app GUID %s)\n", state.Stack, newAppGuid)
+	appRepo.printf("elapsed:   %s\n", elapsed.Round(time.Second))
+}
+
+// printTimings prints how long each step took, to tell which ones are slow.
+func printTimings(out io.Writer, timings []StepTiming) {
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "step timings:")
+	for _, timing := range timings {
+		fmt.Fprintf(out, "  %-24s %s\n", timing.Name+":", timing.Duration.Round(100*time.Millisecond))
+	}
+}
+
+// dryRun shows what the new app would miss if it was only configured from the
+// generated manifest, or the one at manifestPath if any, without modifying
+// anything.
+func dryRun(appRepo *ApplicationRepo, appName string, manifestPath string) error {
+	var err error
+	if manifestPath != "" {
+		err = appRepo.UseManifest(manifestPath, appName)
+	} else {
+		err = appRepo.CreateManifest(appName)
+	}
+	if err != nil {
+		return err
+	}
+	manifest, err := appRepo.ReadManifest()
+	if err != nil {
+		return err
+	}
+
+	appGuid, err := appRepo.GetAppGuid(appName)
+	if err != nil {
+		return err
+	}
+	env, err := appRepo.GetAppEnv(appGuid)
+	if err != nil {
+		return err
+	}
+	services, err := appRepo.GetBoundServices(appGuid)
+	if err != nil {
+		return err
+	}
+	processes, err := appRepo.GetProcesses(appGuid)
+	if err != nil {
+		return err
+	}
+
+	appRepo.printf("\n")
+	DiffManifest(manifest.App(appName), env, services, processes).Print(appRepo.output())
+	return nil
+}
+
 func (BgChangeStackPlugin) GetMetadata() plugin.PluginMetadata {
 	return plugin.PluginMetadata{
-		Name: "bg-change-stack",
-		Version: plugin.VersionType{
-			Major: 1,
-			Minor: 0,
-			Build: 0,
-		},
+		Name:    "bg-change-stack",
+		Version: versionType(),
 		Commands: []plugin.Command{
 			{
 				Name:     "bg-change-stack",
 				HelpText: "Perform a zero-downtime stack change of an application over the top of an old one",
 				UsageDetails: plugin.Usage{
-					Usage: "$ cf bg-change-stack <app name> <new stack name>",
+					Usage: "$ cf bg-change-stack <app name>... <new stack name>" + exitCodesUsage,
+					Options: withUsageOptions(changeStackUsageOptions(), batchUsageOptions(), map[string]string{
+						"version": "Print the version of the plugin, with the commit and date it was built from",
+					}),
+				},
+			},
+			{
+				Name:     "bg-change-stack-select",
+				HelpText: "Perform a zero-downtime stack change of every app in the current space matching a label selector",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf bg-change-stack-select --labels <selector> <new stack name>" + exitCodesUsage,
+					Options: withUsageOptions(changeStackUsageOptions(), batchUsageOptions(), map[string]string{
+						"labels": "v3 label selector, e.g. migrate-to=cflinuxfs4",
+					}),
+				},
+			},
+			{
+				Name:     "bg-change-stack-rollback",
+				HelpText: "Restore the old app after a stack change which died without rolling back",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf bg-change-stack-rollback <app name>",
+					Options: map[string]string{
+						"venerable-suffix": "Suffix the name of the old app was given, if --venerable-suffix was passed to bg-change-stack (default -venerable)",
+					},
+				},
+			},
+			{
+				Name:     "bg-change-stack-restore",
+				HelpText: "Restore the stack, env, services, routes and scale of an app from a snapshot taken with --snapshot",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf bg-change-stack-restore <app name> --snapshot <snapshot file>",
+					Options: map[string]string{
+						"snapshot": "Snapshot written by bg-change-stack --snapshot",
+					},
+				},
+			},
+			{
+				Name:     "bg-validate-snapshot",
+				HelpText: "Check offline whether the app described by a snapshot can have its stack changed",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf bg-validate-snapshot <snapshot file>",
+				},
+			},
+			{
+				Name:     "bg-change-stack-audit",
+				HelpText: "List the apps of the current space, or org, with their stacks and whether they are on the target stack",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf bg-change-stack-audit <target stack>",
+					Options: map[string]string{
+						"all-spaces": "List the apps of every space of the current org instead of the current space only",
+					},
+				},
+			},
+			{
+				Name:     "bg-change-stack-check",
+				HelpText: "Check whether an app is ready for its stack to be changed, without modifying anything",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf bg-change-stack-check <app name>",
+					Options: map[string]string{
+						"venerable-suffix": "Suffix the stack change will give to the name of the old app (default -venerable)",
+					},
+				},
+			},
+			{
+				Name:     "bg-stats",
+				HelpText: "Show the number of stack changes run from this machine, as recorded locally",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf bg-stats",
 				},
 			},
 		},
@@ -215,42 +1387,157 @@ func (BgChangeStackPlugin) GetMetadata() plugin.PluginMetadata {
 }
 
 type ApplicationRepo struct {
-	conn plugin.CliConnection
+	conn Connection
 	dir  string
+	// ctx is the context of the operation the repo serves, whose end
+	// interrupts the waits between the attempts of a request.
+	ctx context.Context
+	// out is where the progress and warnings of the operation are
+	// printed, stdout if nil.
+	out io.Writer
+	// PollInterval is the time between two checks of an asynchronous
+	// operation, such as the copy of bits, and PollTimeout the time after
+	// which it is given up on.
+	PollInterval time.Duration
+	PollTimeout  time.Duration
+	// CurlAttempts is the number of times a request to the Cloud
+	// Controller is sent before giving up on it, the first retry being
+	// after RetryBackoff.
+	CurlAttempts int
+	RetryBackoff time.Duration
+	// RateLimitWait is the longest time waited in all for the rate limit
+	// of the Cloud Controller to let a request through.
+	RateLimitWait time.Duration
+}
+
+const (
+	pollIntervalEnv  = "BG_CHANGE_STACK_POLL_INTERVAL"
+	pollTimeoutEnv   = "BG_CHANGE_STACK_POLL_TIMEOUT"
+	curlAttemptsEnv  = "BG_CHANGE_STACK_CURL_ATTEMPTS"
+	rateLimitWaitEnv = "BG_CHANGE_STACK_RATE_LIMIT_WAIT"
+
+	defaultPollInterval  = 2 * time.Second
+	defaultPollTimeout   = 30 * time.Minute
+	defaultCurlAttempts  = 3
+	defaultRetryBackoff  = time.Second
+	defaultRateLimitWait = 5 * time.Minute
+)
+
+func NewApplicationRepo(conn Connection) (*ApplicationRepo, error) {
+	return NewApplicationRepoIn(conn, "")
 }
 
-func NewApplicationRepo(conn plugin.CliConnection) (*ApplicationRepo, error) {
-	dir, err := ioutil.TempDir("", "bg-change-stack")
+// NewApplicationRepoIn creates a repo whose temp dir is created in the given
+// dir, or in $TMPDIR if it is empty. The temp dir is removed when the plugin
+// exits, even when panicking, if it wasn't before.
+func NewApplicationRepoIn(conn Connection, tmpDir string) (*ApplicationRepo, error) {
+	pollInterval, err := durationFromEnv(pollIntervalEnv, defaultPollInterval)
 	if err != nil {
 		return nil, err
 	}
+	pollTimeout, err := durationFromEnv(pollTimeoutEnv, defaultPollTimeout)
+	if err != nil {
+		return nil, err
+	}
+	curlAttempts, err := intFromEnv(curlAttemptsEnv, defaultCurlAttempts)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitWait, err := durationFromEnv(rateLimitWaitEnv, defaultRateLimitWait)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(tmpDir, "bg-change-stack")
+	if err != nil {
+		return nil, err
+	}
+	atExit(func() { os.RemoveAll(dir) })
 	return &ApplicationRepo{
-		conn: conn,
-		dir:  dir,
+		conn:          conn,
+		dir:           dir,
+		ctx:           context.Background(),
+		PollInterval:  pollInterval,
+		PollTimeout:   pollTimeout,
+		CurlAttempts:  curlAttempts,
+		RetryBackoff:  defaultRetryBackoff,
+		RateLimitWait: rateLimitWait,
 	}, nil
 }
 
+// intFromEnv parses the positive integer in the environment variable,
+// returning the default value if it isn't set.
+func intFromEnv(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s', expected a positive integer", name, value)
+	}
+	return n, nil
+}
+
+// durationFromEnv parses the duration in the environment variable, such as
+// 5s, returning the default value if it isn't set.
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s', expected a positive duration such as 5s", name, value)
+	}
+	return d, nil
+}
+
+// context returns the context of the operation the repo serves.
+func (repo *ApplicationRepo) context() context.Context {
+	if repo.ctx == nil {
+		return context.Background()
+	}
+	return repo.ctx
+}
+
+// output returns where the progress and warnings of the operation the repo
+// serves are printed.
+func (repo *ApplicationRepo) output() io.Writer {
+	if repo.out == nil {
+		return os.Stdout
+	}
+	return repo.out
+}
+
+func (repo *ApplicationRepo) printf(format string, args ...interface{}) {
+	fmt.Fprintf(repo.output(), format, args...)
+}
+
 func (repo *ApplicationRepo) DeleteDir() error {
 	return os.RemoveAll(repo.dir)
 }
 
 func (repo *ApplicationRepo) CreateManifest(name string) error {
 	_, err := repo.conn.CliCommand("create-app-manifest", name, "-p", repo.manifestFilePath())
-	return err
+	if err != nil {
+		return err
+	}
+	return repo.CheckManifestValid(name)
 }
 
 func (repo *ApplicationRepo) manifestFilePath() string {
 	return filepath.Join(repo.dir, "manifest.yml")
 }
 
+// TouchDir creates a uniquely named empty file in the dir, for cf push to have
+// something to upload.
 func (repo *ApplicationRepo) TouchDir() error {
-	f, err := os.Create(repo.dir + "/nofile")
+	f, err := ioutil.TempFile(repo.dir, "nofile")
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
-	return nil
+	return f.Close()
 }
 
 func (repo *ApplicationRepo) RenameApplication(oldName, newName string) error {
@@ -258,10 +1545,15 @@ func (repo *ApplicationRepo) RenameApplication(oldName, newName string) error {
 	return err
 }
 
+// PushApplication pushes the app from its manifest and the temp dir, without
+// starting it. The output of cf push is shown as it runs, the error returned
+// through the plugin RPC rarely telling why it failed.
 func (repo *ApplicationRepo) PushApplication(appName string) error {
-	args := []string{"push", appName, "-f", repo.manifestFilePath(), "-p", repo.dir, "--no-start"}
-	_, err := repo.conn.CliCommand(args...)
-	return err
+	_, err := repo.conn.CliCommand("push", appName, "-f", repo.manifestFilePath(), "-p", repo.dir, "--no-start")
+	if err != nil {
+		return fmt.Errorf("cf push %s failed: %s", appName, err)
+	}
+	return nil
 }
 
 func (repo *ApplicationRepo) RestartApplication(appName string) error {
@@ -276,53 +1568,204 @@ func (repo *ApplicationRepo) RestageApplication(appName string) error {
 	return err
 }
 
+func (repo *ApplicationRepo) StartApplication(appName string) error {
+	_, err := repo.conn.CliCommand("start", appName)
+	return err
+}
+
+func (repo *ApplicationRepo) StopApplication(appName string) error {
+	_, err := repo.conn.CliCommand("stop", appName)
+	return err
+}
+
 func (repo *ApplicationRepo) DeleteApplication(appName string) error {
 	_, err := repo.conn.CliCommand("delete", appName, "-f")
 	return err
 }
 
+// WaitForAppDeleted polls the app until it no longer exists, which may take
+// a while after cf delete returned, or until the context is done.
+func (repo *ApplicationRepo) WaitForAppDeleted(ctx context.Context, appName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		exists, err := repo.DoesAppExist(appName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("app %s still exists %s after being deleted", appName, timeout)
+		}
+		err = sleep(ctx, repo.PollInterval)
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func (repo *ApplicationRepo) ListApplications() error {
 	_, err := repo.conn.CliCommand("apps")
 	return err
 }
 
+// CopyBits copies the latest ready package of the old app to the new app, as
+// the deprecated v2 copy_bits endpoint did. The copy goes on asynchronously,
+// it is returned as a job to be polled with GetPackageJob.
+//
+// The package is copied rather than the droplet with /v3/droplets?source_guid=:
+// the droplet was staged on the old stack and can't run on the new one, and
+// the new app, left without a package, couldn't be restaged on it. Copying the
+// package means the new app is always staged again on the new stack.
 func (repo *ApplicationRepo) CopyBits(oldAppGuid, newAppGuid string) (Job, error) {
-	respSlice, err := repo.conn.CliCommandWithoutTerminalOutput(
-		"curl",
-		"-X",
-		"POST",
-		fmt.Sprintf("/v2/apps/%s/copy_bits", newAppGuid),
-		"-d",
-		fmt.Sprintf(`{"source_app_guid":"%s"}`, oldAppGuid),
-	)
+	pkg, err := repo.GetLatestReadyPackage(oldAppGuid)
 	if err != nil {
 		return Job{}, err
 	}
-	resp := strings.Join(respSlice, "\n")
-	var job Job
-	err = json.Unmarshal([]byte(resp), &job)
+	if pkg == nil {
+		return Job{}, fmt.Errorf("app %s has no package to copy", oldAppGuid)
+	}
+	body := map[string]interface{}{
+		"relationships": map[string]interface{}{
+			"app": map[string]interface{}{
+				"data": map[string]string{"guid": newAppGuid},
+			},
+		},
+	}
+	var copied Package
+	err = repo.curlWithBody(&copied, "POST", fmt.Sprintf("/v3/packages?source_guid=%s", url.QueryEscape(pkg.GUID)), body)
 	if err != nil {
 		return Job{}, err
 	}
-	return job, nil
+	// An error body decodes into an empty package, which would be polled
+	// forever.
+	if copied.GUID == "" {
+		return Job{}, fmt.Errorf("copy of package %s didn't return a package", pkg.GUID)
+	}
+	return copied.job(), nil
 }
 
-func (repo *ApplicationRepo) AssignTargetStack(appGuid, stackName string) error {
-	_, err := repo.conn.CliCommandWithoutTerminalOutput(
-		"curl",
-		"-X",
-		"POST",
-		"/v3/apps/"+appGuid, "-X", "PATCH", `-d={"lifecycle":{"type":"buildpack", "data": {"stack":"`+stackName+`"} } }`,
-	)
+// packageJobStates maps the states of packages to those of v3 jobs, a package
+// being copied standing for the job copying it.
+var packageJobStates = map[string]string{
+	"AWAITING_UPLOAD":   "",
+	"PROCESSING_UPLOAD": "PROCESSING",
+	"COPYING":           "PROCESSING",
+	"READY":             "COMPLETE",
+	"FAILED":            "FAILED",
+	"EXPIRED":           "FAILED",
+}
 
-	return err
+func (pkg Package) job() Job {
+	job := Job{GUID: pkg.GUID, State: packageJobStates[pkg.State], CreatedAt: pkg.CreatedAt}
+	job.normalize()
+	if job.Entity.Status == "" {
+		job.Entity.Status = "queued"
+	}
+	if job.Entity.Status == "failed" {
+		job.Entity.Error = fmt.Sprintf("package is %s", pkg.State)
+	}
+	job.Metadata.URL = "/v3/packages/" + url.PathEscape(pkg.GUID)
+	return job
+}
+
+// GetPackageJob gets the job standing for the copy of a package.
+func (repo *ApplicationRepo) GetPackageJob(packageGuid string) (Job, error) {
+	var pkg Package
+	err := repo.curl(&pkg, "/v3/packages/"+url.PathEscape(packageGuid))
+	if err != nil {
+		return Job{}, err
+	}
+	return pkg.job(), nil
+}
+
+// AssignTargetStack changes the stack of the app. Some Cloud Controllers
+// complete the change asynchronously, pointing to a job in the Location
+// header, which is then waited for so the app isn't restaged too early.
+func (repo *ApplicationRepo) AssignTargetStack(ctx context.Context, appGuid, stackName string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"lifecycle": map[string]interface{}{
+			"type": "buildpack",
+			"data": map[string]string{"stack": stackName},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	response, err := repo.curlRaw("-X", "PATCH", "/v3/apps/"+url.PathEscape(appGuid), "-d", string(body))
+	if err != nil {
+		return err
+	}
+	err = responseError(response.Body)
+	if err != nil {
+		return err
+	}
+
+	location := response.Header["location"]
+	if !strings.Contains(location, "/v3/jobs/") {
+		return nil
+	}
+	return repo.WaitForJob(ctx, path.Base(location), repo.PollTimeout, repo.PollInterval)
+}
+
+// WaitForJob polls the v2 or v3 job every interval until it completes, or
+// fails, for at most timeout or until the context is done.
+func (repo *ApplicationRepo) WaitForJob(ctx context.Context, jobGuid string, timeout, interval time.Duration) error {
+	return pollJob(rollbackContext(ctx), jobGuid, repo.GetJob, timeout, interval, nil)
+}
+
+// pollJob gets the job with getJob every interval until it completes, or
+// fails, for at most timeout. Unless nil, poll is passed the job and the time
+// elapsed after each unfinished poll, to report progress or give up early by
+// returning an error.
+func pollJob(ctx context.Context, jobGuid string, getJob func(string) (Job, error), timeout, interval time.Duration, poll func(Job, time.Duration) error) error {
+	start := time.Now()
+	for {
+		job, err := getJob(jobGuid)
+		if err != nil {
+			return err
+		}
+		switch job.Entity.Status {
+		case "finished":
+			return nil
+		case "failed":
+			return job.Failure()
+		}
+
+		elapsed := time.Since(start)
+		if poll != nil {
+			err = poll(job, elapsed)
+			if err != nil {
+				return err
+			}
+		}
+		if elapsed > timeout {
+			return fmt.Errorf("job %s did not finish within %s", jobGuid, timeout)
+		}
+		err = sleep(ctx, interval)
+		if err != nil {
+			return err
+		}
+	}
 }
 
+// GetJob gets a job from the v3 API, or from the v2 API which alone knows
+// about the jobs it created.
 func (repo *ApplicationRepo) GetJob(jobGuid string) (Job, error) {
-	respSlice, err := repo.conn.CliCommandWithoutTerminalOutput(
-		"curl",
-		fmt.Sprintf("/v2/jobs/%s", jobGuid),
+	var v3Job Job
+	err := repo.curl(&v3Job, "/v3/jobs/"+url.PathEscape(jobGuid))
+	if err == nil && v3Job.GUID != "" {
+		v3Job.normalize()
+		return v3Job, nil
+	}
+
+	respSlice, err := repo.curlOutput(
+		"/v2/jobs/" + url.PathEscape(jobGuid),
 	)
+	if err != nil {
+		return Job{}, err
+	}
 	resp := strings.Join(respSlice, "\n")
 	var job Job
 	err = json.Unmarshal([]byte(resp), &job)
@@ -332,6 +1775,8 @@ func (repo *ApplicationRepo) GetJob(jobGuid string) (Job, error) {
 	return job, nil
 }
 
+var guidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
 func (repo *ApplicationRepo) GetAppGuid(name string) (string, error) {
 	d, err := repo.conn.CliCommandWithoutTerminalOutput("app", name, "--guid")
 	if err != nil {
@@ -340,7 +1785,14 @@ func (repo *ApplicationRepo) GetAppGuid(name string) (string, error) {
 	if len(d) == 0 {
 		return "", fmt.Errorf("app '%s' not found.", name)
 	}
-	return d[0], err
+	// cf may print warnings, e.g. about its version, around the GUID.
+	for _, line := range d {
+		line = strings.TrimSpace(line)
+		if guidPattern.MatchString(line) {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("no GUID in the output of cf app %s --guid: %s", name, strings.Join(d, " "))
 }
 
 func (repo *ApplicationRepo) DoesAppExist(appName string) (bool, error) {
@@ -349,8 +1801,8 @@ func (repo *ApplicationRepo) DoesAppExist(appName string) (bool, error) {
 		return false, err
 	}
 
-	path := fmt.Sprintf(`v2/apps?q=name:%s&q=space_guid:%s`, url.QueryEscape(appName), space.Guid)
-	result, err := repo.conn.CliCommandWithoutTerminalOutput("curl", path)
+	path := fmt.Sprintf(`v2/apps?q=name:%s&q=space_guid:%s`, url.QueryEscape(appName), url.QueryEscape(space.Guid))
+	result, err := repo.curlOutput(path)
 
 	if err != nil {
 		return false, err
@@ -379,3 +1831,68 @@ func (repo *ApplicationRepo) DoesAppExist(appName string) (bool, error) {
 
 	return count == 1, nil
 }
+
+func (repo *ApplicationRepo) GetAppNamesByLabelSelector(selector string) ([]string, error) {
+	space, err := repo.conn.GetCurrentSpace()
+	if err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf("/v3/apps?label_selector=%s&space_guids=%s&per_page=5000", url.QueryEscape(selector), url.QueryEscape(space.Guid))
+	var apps []struct {
+		Name string `json:"name"`
+	}
+	err = repo.curlAll(&apps, path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(apps))
+	for _, app := range apps {
+		names = append(names, app.Name)
+	}
+	return names, nil
+}
+
+type Package struct {
+	GUID      string    `json:"guid"`
+	Type      string    `json:"type"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      struct {
+		Checksum struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"checksum"`
+	} `json:"data"`
+}
+
+// GetLatestReadyPackage returns the most recent READY bits package of the app,
+// or nil if it has none.
+func (repo *ApplicationRepo) GetLatestReadyPackage(appGuid string) (*Package, error) {
+	var packages struct {
+		Resources []Package `json:"resources"`
+	}
+	err := repo.curl(&packages, fmt.Sprintf("/v3/apps/%s/packages?states=READY&types=bits&order_by=-created_at", url.PathEscape(appGuid)))
+	if err != nil {
+		return nil, err
+	}
+	if len(packages.Resources) == 0 {
+		return nil, nil
+	}
+	return &packages.Resources[0], nil
+}
+
+// HasBitsOf tells whether the app already has a READY package with the same
+// checksum as the latest READY package of the source app.
+func (repo *ApplicationRepo) HasBitsOf(appGuid, sourceAppGuid string) (bool, error) {
+	pkg, err := repo.GetLatestReadyPackage(appGuid)
+	if err != nil || pkg == nil {
+		return false, err
+	}
+	sourcePkg, err := repo.GetLatestReadyPackage(sourceAppGuid)
+	if err != nil || sourcePkg == nil {
+		return false, err
+	}
+	return pkg.Data.Checksum.Value != "" && pkg.Data.Checksum == sourcePkg.Data.Checksum, nil
+}
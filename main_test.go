@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyBits(t *testing.T) {
+	tests := []struct {
+		name         string
+		packageState string
+		err          string
+	}{
+		{"copied", "READY", ""},
+		{"failed", "FAILED", "package is FAILED"},
+		{"timed out", "COPYING", "did not finish within"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cf := newFakeCF("app", "app-venerable")
+			cf.curl = func(method, path string) (int, string) {
+				if method == http.MethodGet && strings.HasPrefix(path, "/v3/packages/copied-package-guid") {
+					return http.StatusOK, fmt.Sprintf(`{"guid":"copied-package-guid","state":"%s"}`, test.packageState)
+				}
+				return 0, ""
+			}
+			repo := testRepo(t, cf)
+			repo.PollTimeout = 20 * time.Millisecond
+			options := testOptions(t)
+
+			err := copyBits(context.Background(), repo, cf.apps["app-venerable"], cf.apps["app"], "app", options)
+			if test.err == "" && err != nil {
+				t.Fatalf("copyBits() = %v, want no error", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("copyBits() = %v, want an error containing %q", err, test.err)
+			}
+			if !cf.ran("curl", "-i", "-X", "POST", "/v3/packages?source_guid=package-of-"+cf.apps["app-venerable"], "-d", `{"relationships":{"app":{"data":{"guid":"`+cf.apps["app"]+`"}}}}`) {
+				t.Errorf("the package of the old app wasn't copied to the new app, ran %v", cf.commands)
+			}
+		})
+	}
+}
+
+func TestCopyBitsFallsBackToPushOnlyWhenCopyIsDisabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     int
+		fallback bool
+	}{
+		{"feature disabled", featureDisabled, true},
+		{"not authorized", 10003, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cf := newFakeCF("app", "app-venerable")
+			cf.curl = func(method, path string) (int, string) {
+				if method == http.MethodPost && strings.HasPrefix(path, "/v3/packages?") {
+					return http.StatusForbidden, fmt.Sprintf(`{"errors":[{"code":%d,"title":"CF-Refused","detail":"copy refused"}]}`, test.code)
+				}
+				return 0, ""
+			}
+			repo := testRepo(t, cf)
+
+			err := copyBits(context.Background(), repo, cf.apps["app-venerable"], cf.apps["app"], "app", testOptions(t))
+			if test.fallback && err != nil {
+				t.Fatalf("copyBits() = %v, want the package pushed instead", err)
+			}
+			if !test.fallback {
+				apiErr, ok := err.(APIError)
+				if !ok || apiErr.Code != test.code {
+					t.Fatalf("copyBits() = %v, want the error %d of the copy", err, test.code)
+				}
+			}
+			if pushed := cf.count("push") == 1; pushed != test.fallback {
+				t.Errorf("package pushed: %t, want %t, ran %v", pushed, test.fallback, cf.commands)
+			}
+		})
+	}
+}
+
+// migrate runs the plan of the stack change of the app against the fake cf.
+func migrate(t *testing.T, cf *fakeCF, appName string, args ...string) (Plan, error) {
+	t.Helper()
+	plan := changeStackActions(context.Background(), testRepo(t, cf), appName, "cflinuxfs4", testOptions(t, args...), &StateFile{})
+	plan.Output = ioutil.Discard
+	err := plan.Execute(context.Background())
+	return plan, err
+}
+
+func TestChangeStackRenamesOldAppBackWhenPushFails(t *testing.T) {
+	cf := newFakeCF("app")
+	oldAppGuid := cf.apps["app"]
+	cf.fail["push"] = true
+
+	plan, err := migrate(t, cf, "app")
+	if err == nil {
+		t.Fatal("the stack change succeeded although the push failed")
+	}
+	if !cf.ran("rename", "app-venerable", "app") {
+		t.Errorf("app-venerable wasn't renamed back to app, ran %v", cf.commands)
+	}
+	if !plan.RolledBack() {
+		t.Errorf("the stack change wasn't rolled back: %v", err)
+	}
+	if cf.apps["app"] != oldAppGuid {
+		t.Errorf("app is %s, want the old app %s", cf.apps["app"], oldAppGuid)
+	}
+}
+
+// failCurl makes the requests with the given method and path prefix fail with
+// an error of the Cloud Controller.
+func failCurl(cf *fakeCF, method, pathPrefix string) {
+	cf.curl = func(requestMethod, path string) (int, string) {
+		if requestMethod == method && strings.HasPrefix(path, pathPrefix) {
+			return http.StatusUnprocessableEntity, `{"errors":[{"code":10008,"title":"CF-UnprocessableEntity","detail":"request failed"}]}`
+		}
+		return 0, ""
+	}
+}
+
+func TestChangeStackDeletesNewAppOnlyOnceOldAppWasRenamed(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(cf *fakeCF)
+		// deleted tells whether the new app exists to be deleted when
+		// the step fails.
+		deleted     bool
+		renamedBack bool
+	}{
+		{"rename", func(cf *fakeCF) { cf.fail["rename"] = true }, false, false},
+		{"push", func(cf *fakeCF) { cf.fail["push"] = true }, false, true},
+		{"copy_bits", func(cf *fakeCF) { failCurl(cf, http.MethodPost, "/v3/packages?") }, true, true},
+		{"restart", func(cf *fakeCF) { cf.fail["restart"] = true }, true, true},
+		{"change_stack", func(cf *fakeCF) { failCurl(cf, http.MethodPatch, "/v3/apps/") }, true, true},
+		{"restage", func(cf *fakeCF) { cf.fail["restage"] = true }, true, true},
+		// Only the new app, called app once the old one is renamed, is
+		// waited for.
+		{"wait_running", func(cf *fakeCF) { cf.notRunning["app"] = true }, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name+" fails", func(t *testing.T) {
+			cf := newFakeCF("app")
+			oldAppGuid := cf.apps["app"]
+			test.fail(cf)
+
+			plan, err := migrate(t, cf, "app", "--start-timeout", "50ms")
+			if err == nil {
+				t.Fatal("the stack change succeeded although a step failed")
+			}
+			if failed := plan.Timings[len(plan.Timings)-1].Name; failed != test.name {
+				t.Errorf("step %s failed with %q, want step %s to fail", failed, err, test.name)
+			}
+			if deleted := cf.ran("delete", "app", "-f"); deleted != test.deleted {
+				t.Errorf("app deleted: %t, want %t, ran %v", deleted, test.deleted, cf.commands)
+			}
+			if renamedBack := cf.ran("rename", "app-venerable", "app"); renamedBack != test.renamedBack {
+				t.Errorf("app-venerable renamed back: %t, want %t, ran %v", renamedBack, test.renamedBack, cf.commands)
+			}
+			if plan.RollbackAttempted() != test.renamedBack {
+				t.Errorf("rollback attempted: %t, want %t", plan.RollbackAttempted(), test.renamedBack)
+			}
+			if cf.apps["app"] != oldAppGuid {
+				t.Errorf("app is %s, want the old app %s", cf.apps["app"], oldAppGuid)
+			}
+		})
+	}
+}
+
+func TestPollJob(t *testing.T) {
+	failed := Job{GUID: "job-guid", State: "FAILED", Errors: []APIError{{Code: 10008, Title: "CF-UnprocessableEntity", Detail: "stack not found"}}}
+	tests := []struct {
+		name string
+		job  Job
+		err  string
+	}{
+		{"complete", Job{GUID: "job-guid", State: "COMPLETE"}, ""},
+		{"failed", failed, "CF-UnprocessableEntity: stack not found [code: 10008]"},
+		{"timed out", Job{GUID: "job-guid", State: "PROCESSING"}, "job job-guid did not finish within 20ms"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			polls := 0
+			getJob := func(jobGuid string) (Job, error) {
+				polls++
+				job := test.job
+				job.normalize()
+				return job, nil
+			}
+
+			err := pollJob(context.Background(), "job-guid", getJob, 20*time.Millisecond, time.Millisecond, nil)
+			if test.err == "" && err != nil {
+				t.Fatalf("pollJob() = %v, want no error", err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Fatalf("pollJob() = %v, want %q", err, test.err)
+			}
+			if test.job.State != "PROCESSING" && polls != 1 {
+				t.Errorf("the %s job was polled %d times, want once", test.job.State, polls)
+			}
+		})
+	}
+}
+
+func TestGetJobFallsBackToV2(t *testing.T) {
+	cf := newFakeCF()
+	cf.curl = func(method, path string) (int, string) {
+		switch path {
+		case "/v3/jobs/v2-job-guid":
+			return http.StatusNotFound, `{"errors":[{"code":10010,"title":"CF-ResourceNotFound","detail":"Job not found"}]}`
+		case "/v2/jobs/v2-job-guid":
+			return http.StatusOK, `{"metadata":{"guid":"v2-job-guid"},"entity":{"guid":"v2-job-guid","status":"failed","error_details":{"code":170001,"description":"Staging error","error_code":"CF-StagingError"}}}`
+		}
+		return 0, ""
+	}
+
+	job, err := testRepo(t, cf).GetJob("v2-job-guid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Entity.Status != "failed" {
+		t.Errorf("job status = %q, want failed", job.Entity.Status)
+	}
+	want := "Error CF-StagingError, Staging error [code: 170001]"
+	if job.Failure() == nil || job.Failure().Error() != want {
+		t.Errorf("job failure = %v, want %q", job.Failure(), want)
+	}
+}
+
+func TestDoesAppExistEscapesName(t *testing.T) {
+	for _, appName := range []string{"app+blue", "50%off", "app&q=name:other", "app#1", "my app"} {
+		t.Run(appName, func(t *testing.T) {
+			cf := newFakeCF(appName, "other")
+			exists, err := testRepo(t, cf).DoesAppExist(appName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exists {
+				t.Errorf("app %q not found, requested %v", appName, cf.curlPaths())
+			}
+		})
+	}
+}
+
+func TestGuidsAreEscapedInPaths(t *testing.T) {
+	cf := newFakeCF()
+	repo := testRepo(t, cf)
+	repo.GetProcesses("guid/../x?y")
+	repo.GetPackageJob("guid#z")
+
+	want := []string{"/v3/apps/guid%2F..%2Fx%3Fy/processes?", "/v3/packages/guid%23z"}
+	paths := cf.curlPaths()
+	if len(paths) != len(want) {
+		t.Fatalf("requested %v, want %d requests", paths, len(want))
+	}
+	for i, path := range paths {
+		if !strings.HasPrefix(path, want[i]) {
+			t.Errorf("requested %s, want %s", path, want[i])
+		}
+	}
+}
+
+func TestPreserveGUIDRestartsAppBackOnlyOnceRestarted(t *testing.T) {
+	tests := []struct {
+		name string
+		fail func(cf *fakeCF)
+		// restarts counts the restarts of the app, the failed one included.
+		restarts int
+	}{
+		{"copy_droplet", func(cf *fakeCF) { failCurl(cf, http.MethodPost, "/v3/droplets?") }, 0},
+		{"restart", func(cf *fakeCF) { cf.fail["restart"] = true }, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name+" fails", func(t *testing.T) {
+			cf := newFakeCF("app")
+			test.fail(cf)
+
+			plan := preserveGUIDChangeStackActions(context.Background(), testRepo(t, cf), "app", "cflinuxfs4", testOptions(t, "--preserve-guid"))
+			plan.Output = ioutil.Discard
+			err := plan.Execute(context.Background())
+			if err == nil {
+				t.Fatal("the stack change succeeded although a step failed")
+			}
+			if failed := plan.Timings[len(plan.Timings)-1].Name; failed != test.name {
+				t.Fatalf("step %s failed with %q, want step %s to fail", failed, err, test.name)
+			}
+			if restarts := cf.count("restart"); restarts != test.restarts {
+				t.Errorf("app restarted %d times, want %d, ran %v", restarts, test.restarts, cf.commands)
+			}
+			if !cf.ran("curl", "-i", "-X", "PATCH", "/v3/apps/"+cf.apps["app"]+"/relationships/current_droplet", "-d", `{"data":{"guid":"droplet-guid"}}`) {
+				t.Errorf("the old droplet wasn't set back, ran %v", cf.commands)
+			}
+		})
+	}
+}
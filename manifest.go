@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Manifest struct {
+	Applications []map[string]interface{} `yaml:"applications"`
+}
+
+// manifestIgnoredKeys are the keys which don't count as configuration when
+// deciding whether a manifest entry is blank: cf create-app-manifest writes
+// them for every app and its processes, even when left to their defaults.
+var manifestIgnoredKeys = map[string]bool{
+	"name":                        true,
+	"stack":                       true,
+	"instances":                   true,
+	"memory":                      true,
+	"disk_quota":                  true,
+	"log-rate-limit-per-second":   true,
+	"type":                        true,
+	"health-check-type":           true,
+	"readiness-health-check-type": true,
+}
+
+// App returns the manifest entry of the named app, or nil if there is none.
+func (manifest Manifest) App(name string) map[string]interface{} {
+	for _, app := range manifest.Applications {
+		if app["name"] == name {
+			return app
+		}
+	}
+	return nil
+}
+
+func (repo *ApplicationRepo) ReadManifest() (Manifest, error) {
+	var manifest Manifest
+	content, err := ioutil.ReadFile(repo.manifestFilePath())
+	if err != nil {
+		return manifest, err
+	}
+	err = yaml.Unmarshal(content, &manifest)
+	return manifest, err
+}
+
+// ManifestContent returns the content of the manifest of the app.
+func (repo *ApplicationRepo) ManifestContent() (string, error) {
+	content, err := ioutil.ReadFile(repo.manifestFilePath())
+	return string(content), err
+}
+
+// WriteManifest writes the manifest of the app and the fake file pushed with
+// it, as when resuming after they were created by a previous run.
+func (repo *ApplicationRepo) WriteManifest(content string) error {
+	err := ioutil.WriteFile(repo.manifestFilePath(), []byte(content), 0600)
+	if err != nil {
+		return err
+	}
+	return repo.TouchDir()
+}
+
+// SetManifestBuildpacks sets the buildpacks of the app in its manifest.
+func (repo *ApplicationRepo) SetManifestBuildpacks(appName string, buildpacks []string) error {
+	manifest, err := repo.ReadManifest()
+	if err != nil {
+		return err
+	}
+	app := manifest.App(appName)
+	if app == nil {
+		return fmt.Errorf("app '%s' not found in its manifest", appName)
+	}
+	delete(app, "buildpack")
+	app["buildpacks"] = buildpacks
+
+	content, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(repo.manifestFilePath(), content, 0600)
+}
+
+// UseManifest copies the manifest at the given path to the temp dir, to push
+// the app from it instead of from a generated one. The manifest must hold the
+// app.
+func (repo *ApplicationRepo) UseManifest(path, appName string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var manifest Manifest
+	err = yaml.Unmarshal(content, &manifest)
+	if err != nil {
+		return fmt.Errorf("invalid manifest %s: %s", path, err)
+	}
+	if manifest.App(appName) == nil {
+		return fmt.Errorf("manifest %s doesn't hold app '%s'", path, appName)
+	}
+	return ioutil.WriteFile(repo.manifestFilePath(), content, 0600)
+}
+
+// CheckManifestValid makes sure cf create-app-manifest wrote a manifest
+// holding the app, as it may not report failing to: pushing from an empty or
+// broken manifest would fail in ways unrelated to the cause.
+func (repo *ApplicationRepo) CheckManifestValid(appName string) error {
+	content, err := repo.ManifestContent()
+	if os.IsNotExist(err) {
+		return fmt.Errorf("cf create-app-manifest %s wrote no manifest", appName)
+	}
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(content) == "" {
+		return fmt.Errorf("cf create-app-manifest %s wrote an empty manifest", appName)
+	}
+	var manifest Manifest
+	err = yaml.Unmarshal([]byte(content), &manifest)
+	if err != nil {
+		return fmt.Errorf("cf create-app-manifest %s wrote an invalid manifest: %s", appName, err)
+	}
+	if manifest.App(appName) == nil {
+		return fmt.Errorf("the manifest written by cf create-app-manifest %s doesn't hold app '%s'", appName, appName)
+	}
+	return nil
+}
+
+// CheckManifestNotBlank makes sure the generated manifest captured some
+// configuration of the app: pushing from a blank manifest would rebuild the
+// app with default settings only.
+func (repo *ApplicationRepo) CheckManifestNotBlank(appName string) error {
+	manifest, err := repo.ReadManifest()
+	if err != nil {
+		return err
+	}
+	app := manifest.App(appName)
+	if hasConfiguration(app) {
+		return nil
+	}
+	return fmt.Errorf(
+		"the manifest generated for app '%s' holds no configuration, the new app would not be configured like the old one; "+
+			"check the app with `cf create-app-manifest %s` and configure it (memory, instances, routes...) before changing its stack",
+		appName, appName,
+	)
+}
+
+// hasConfiguration tells whether the manifest entry of an app holds keys
+// other than manifestIgnoredKeys, either itself or in its processes.
+func hasConfiguration(entry map[string]interface{}) bool {
+	for key, value := range entry {
+		if key == "processes" {
+			processes, _ := value.([]interface{})
+			for _, process := range processes {
+				fields, _ := process.(map[interface{}]interface{})
+				for field := range fields {
+					if name, ok := field.(string); !ok || !manifestIgnoredKeys[name] {
+						return true
+					}
+				}
+			}
+			continue
+		}
+		if !manifestIgnoredKeys[key] {
+			return true
+		}
+	}
+	return false
+}
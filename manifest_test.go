@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckManifestNotBlank(t *testing.T) {
+	// The manifest cf create-app-manifest writes for an app left to its
+	// defaults.
+	defaults := `---
+applications:
+- name: app
+  instances: 1
+  memory: 256M
+  disk_quota: 1G
+  log-rate-limit-per-second: -1
+  stack: cflinuxfs3
+  processes:
+  - type: web
+    instances: 1
+    memory: 256M
+    disk_quota: 1024M
+    log-rate-limit-per-second: -1
+    health-check-type: port
+    readiness-health-check-type: process
+`
+	tests := []struct {
+		name     string
+		manifest string
+		blank    bool
+	}{
+		{"defaults", defaults, true},
+		{"routes", defaults + "  routes:\n  - route: app.example.com\n", false},
+		{"no route", defaults + "  no-route: true\n", false},
+		{"env", defaults + "  env:\n    MODE: production\n", false},
+		{"services", defaults + "  services:\n  - db\n", false},
+		{"buildpacks", defaults + "  buildpacks:\n  - go_buildpack\n", false},
+		{"process command", strings.Replace(defaults, "    health-check-type: port\n", "    health-check-type: port\n    command: ./server\n", 1), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := testRepo(t, newFakeCF())
+			err := repo.WriteManifest(test.manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = repo.CheckManifestNotBlank("app")
+			if blank := err != nil; blank != test.blank {
+				t.Errorf("manifest blank: %t, want %t: %v", blank, test.blank, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// changeStackOptions tunes how the stack of an app is changed. It is shared by
+// all the commands migrating apps.
+type changeStackOptions struct {
+	SkipCopyIfPresent      bool
+	MaxCopyBitsWait        time.Duration
+	CopyBitsStartTimeout   time.Duration
+	NoTelemetry            bool
+	Probe                  bool
+	ProbeInterval          time.Duration
+	ProbeDeadline          time.Duration
+	Strict                 bool
+	Resume                 bool
+	Rollback               bool
+	DryRun                 bool
+	Fast                   bool
+	PreserveGUID           bool
+	Explain                bool
+	Preserve               string
+	NoPreserve             string
+	CommandWarnAfter       time.Duration
+	CommandTimeout         time.Duration
+	AppTimeout             time.Duration
+	Parallel               int
+	VenerableSuffix        string
+	Force                  bool
+	Output                 string
+	StartTimeout           time.Duration
+	FailFast               bool
+	Interactive            bool
+	KeepVenerable          bool
+	AppStartTimeout        time.Duration
+	Strategy               string
+	MatchInstances         bool
+	Verbose                bool
+	Org                    string
+	Space                  string
+	Timeout                time.Duration
+	DeleteVenerableTimeout time.Duration
+	DownloadDroplet        bool
+	Timings                bool
+	HealthCheckType        string
+	Quiet                  bool
+	Manifest               string
+	StartCommand           string
+	LogFile                string
+	SmokeTest              string
+	TmpDir                 string
+	AllowDowngrade         bool
+	NoRestart              bool
+	Snapshot               string
+	StartRetries           int
+	ResultFile             string
+	Drain                  int
+	// Preserved is the set of categories of configuration to preserve,
+	// resolved from Preserve and NoPreserve by Validate.
+	Preserved map[string]bool
+}
+
+// changeStackFlags registers the flags of changeStackOptions on the given
+// flag set and returns the options they are parsed into.
+func changeStackFlags(flags *flag.FlagSet) *changeStackOptions {
+	options := &changeStackOptions{}
+	flags.BoolVar(&options.SkipCopyIfPresent, "skip-copy-if-present", false, "don't copy bits when the new app already has a ready package matching the old app")
+	flags.DurationVar(&options.MaxCopyBitsWait, "max-copy-bits-wait", 0, "maximum time to wait for bits to be copied")
+	flags.DurationVar(&options.CopyBitsStartTimeout, "copy-bits-start-timeout", 5*time.Minute, "maximum time the copy-bits job may stay queued")
+	flags.BoolVar(&options.NoTelemetry, "no-telemetry", false, "don't count the migration in the local usage stats")
+	flags.BoolVar(&options.Probe, "probe", false, "probe the routes of the app during the cutover and report failures")
+	flags.DurationVar(&options.ProbeInterval, "probe-interval", 100*time.Millisecond, "interval between route probes")
+	flags.DurationVar(&options.ProbeDeadline, "probe-deadline", time.Hour, "maximum time to probe the routes for")
+	flags.BoolVar(&options.Strict, "strict", false, "treat pre-flight warnings as errors")
+	flags.BoolVar(&options.Resume, "resume", false, "resume an interrupted stack change")
+	flags.BoolVar(&options.Rollback, "rollback", false, "roll back an interrupted stack change")
+	flags.BoolVar(&options.DryRun, "dry-run", false, "show what the manifest doesn't capture without changing anything")
+	flags.BoolVar(&options.Fast, "fast", false, "change the stack in place, with downtime")
+	flags.BoolVar(&options.Fast, "in-place", false, "same as --fast")
+	flags.BoolVar(&options.PreserveGUID, "preserve-guid", false, "keep the GUID of the app, restarting it in place while a temporary app serves its routes")
+	flags.BoolVar(&options.Explain, "explain", false, "explain why each step is run")
+	flags.StringVar(&options.Preserve, "preserve", "", "comma separated categories of configuration to preserve")
+	flags.StringVar(&options.NoPreserve, "no-preserve", "", "comma separated categories of configuration not to preserve")
+	flags.DurationVar(&options.CommandWarnAfter, "command-warn-after", 2*time.Minute, "warn when a cf command takes longer than this")
+	flags.DurationVar(&options.CommandTimeout, "command-timeout", time.Hour, "give up on a cf command taking longer than this and roll back")
+	flags.StringVar(&options.VenerableSuffix, "venerable-suffix", defaultVenerableSuffix, "suffix appended to the name of the old app while the new app is built")
+	flags.BoolVar(&options.Force, "force", false, "delete an app left by a previous failed run in the way of the old app, and migrate apps already on the new stack")
+	flags.StringVar(&options.Output, "output", textOutput, "format of the output, text or json")
+	flags.DurationVar(&options.StartTimeout, "start-timeout", 5*time.Minute, "maximum time to wait for the instances of the new app to be running")
+	flags.BoolVar(&options.Interactive, "interactive", false, "ask before deleting the old app")
+	flags.BoolVar(&options.KeepVenerable, "keep-venerable", false, "stop the old app instead of deleting it")
+	flags.DurationVar(&options.AppStartTimeout, "app-start-timeout", 0, "time the instances of the new app have to pass their health check when starting")
+	flags.StringVar(&options.Strategy, "strategy", pushStrategy, "how the new app is built, push or droplet")
+	flags.BoolVar(&options.MatchInstances, "match-instances", true, "give the new app as many instances as the old one")
+	flags.BoolVar(&options.Verbose, "verbose", false, "print the cf commands run to stderr")
+	flags.StringVar(&options.Org, "org", "", "org of the apps, instead of the targeted one")
+	flags.StringVar(&options.Space, "space", "", "space of the apps, instead of the targeted one")
+	flags.DurationVar(&options.Timeout, "timeout", 0, "roll back and give up once the command has run this long")
+	flags.DurationVar(&options.DeleteVenerableTimeout, "delete-venerable-timeout", time.Minute, "maximum time to wait for the old app to be gone once deleted")
+	flags.BoolVar(&options.DownloadDroplet, "download-droplet", false, "push the new app with the downloaded droplet of the old app rather than an empty dir")
+	flags.BoolVar(&options.Timings, "timings", false, "print how long each step took")
+	flags.StringVar(&options.HealthCheckType, "health-check-type", "", "health check type of the new app during the migration, http, port or process")
+	flags.BoolVar(&options.Quiet, "quiet", false, "print errors only, to stderr")
+	flags.StringVar(&options.Manifest, "manifest", "", "manifest to push the new app with instead of a generated one")
+	flags.StringVar(&options.StartCommand, "start-command", "", "start command of the web process of the new app")
+	flags.StringVar(&options.LogFile, "log-file", "", "file to append a log of the steps, commands and errors to")
+	flags.StringVar(&options.SmokeTest, "smoke-test", "", "shell command checking the new app before the old one is deleted")
+	flags.StringVar(&options.TmpDir, "tmp-dir", "", "dir to create the temp dir of the manifest in, instead of $TMPDIR")
+	flags.BoolVar(&options.AllowDowngrade, "allow-downgrade", false, "allow moving apps to an older stack")
+	flags.BoolVar(&options.NoRestart, "no-restart", false, "leave the new app stopped, only staging it on the new stack")
+	flags.StringVar(&options.Snapshot, "snapshot", "", "write the configuration of the old app as JSON to this file before changing anything")
+	flags.IntVar(&options.StartRetries, "app-start-timeout-retries", 0, "number of times the new app is restarted when it fails to start, before rolling back")
+	flags.StringVar(&options.ResultFile, "result-file", "", "write the GUID, routes and stack of the new app as JSON to this file once done")
+	flags.IntVar(&options.Drain, "drain", 0, "seconds to wait after stopping the old app before deleting it")
+	return options
+}
+
+// Validate checks the options are consistent and resolves the values derived
+// from them.
+func (options *changeStackOptions) Validate() error {
+	if options.Fast && options.PreserveGUID {
+		return fmt.Errorf("--fast and --preserve-guid can't be used together")
+	}
+	if options.Output != textOutput && options.Output != jsonOutput {
+		return fmt.Errorf("--output must be %s or %s", textOutput, jsonOutput)
+	}
+	if options.Strategy != pushStrategy && options.Strategy != dropletStrategy {
+		return fmt.Errorf("--strategy must be %s or %s", pushStrategy, dropletStrategy)
+	}
+	if options.Strategy == dropletStrategy && (options.Fast || options.PreserveGUID) {
+		return fmt.Errorf("--strategy %s can't be used with --fast or --preserve-guid", dropletStrategy)
+	}
+	if options.DownloadDroplet && (options.Fast || options.PreserveGUID || options.Strategy == dropletStrategy) {
+		return fmt.Errorf("--download-droplet can't be used with --fast, --preserve-guid or --strategy %s", dropletStrategy)
+	}
+	if options.HealthCheckType != "" && !isHealthCheckType(options.HealthCheckType) {
+		return fmt.Errorf("--health-check-type must be one of %s", strings.Join(healthCheckTypes, ", "))
+	}
+	if options.NoRestart && (options.Fast || options.PreserveGUID || options.Strategy == dropletStrategy) {
+		return fmt.Errorf("--no-restart can't be used with --fast, --preserve-guid or --strategy %s", dropletStrategy)
+	}
+	if options.Manifest != "" && (options.Fast || options.PreserveGUID || options.Strategy == dropletStrategy) {
+		return fmt.Errorf("--manifest can't be used with --fast, --preserve-guid or --strategy %s", dropletStrategy)
+	}
+	if options.Drain < 0 {
+		return fmt.Errorf("--drain must not be negative")
+	}
+	if options.Drain > 0 && options.KeepVenerable {
+		return fmt.Errorf("--drain can't be used with --keep-venerable, which stops the old app without deleting it")
+	}
+	if options.StartRetries < 0 {
+		return fmt.Errorf("--app-start-timeout-retries must not be negative")
+	}
+	if options.Fast || options.PreserveGUID {
+		// These plans neither start a new app nor delete an old one, they
+		// have no step for these flags.
+		unsupported := []struct {
+			flag string
+			set  bool
+		}{
+			{"--smoke-test", options.SmokeTest != ""},
+			{"--keep-venerable", options.KeepVenerable},
+			{"--drain", options.Drain > 0},
+			{"--interactive", options.Interactive},
+			{"--health-check-type", options.HealthCheckType != ""},
+			{"--app-start-timeout", options.AppStartTimeout > 0},
+			{"--app-start-timeout-retries", options.StartRetries > 0},
+			{"--start-command", options.StartCommand != ""},
+		}
+		for _, flag := range unsupported {
+			if flag.set {
+				return fmt.Errorf("%s can't be used with --fast, --in-place or --preserve-guid", flag.flag)
+			}
+		}
+	}
+	if options.Parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+	if options.Parallel > 1 && options.Interactive {
+		return fmt.Errorf("--parallel can't be used with --interactive")
+	}
+	if options.Quiet && (options.Verbose || options.Interactive || options.Output == jsonOutput) {
+		return fmt.Errorf("--quiet can't be used with --verbose, --interactive or --output %s", jsonOutput)
+	}
+	if options.VenerableSuffix == "" {
+		return fmt.Errorf("--venerable-suffix can't be empty")
+	}
+
+	var err error
+	options.Preserved, err = preservedCategories(options.Preserve, options.NoPreserve)
+	if err != nil {
+		return err
+	}
+	// Without a manifest, the new app only gets these from the old one.
+	if options.Strategy == dropletStrategy {
+		for _, category := range []string{preserveEnv, preserveServices, preserveRoutes} {
+			if !options.Preserved[category] {
+				return fmt.Errorf("--strategy %s must preserve %s, the new app isn't pushed with a manifest giving them", dropletStrategy, category)
+			}
+		}
+	}
+	return nil
+}
+
+// changeStackUsageOptions documents the flags of changeStackOptions in the
+// plugin metadata.
+func changeStackUsageOptions() map[string]string {
+	return map[string]string{
+		"skip-copy-if-present":      "Don't copy bits when the new app already has a ready package matching the old app, e.g. when re-running a failed change",
+		"max-copy-bits-wait":        "Maximum time to wait for bits to be copied, e.g. 45m (default $BG_CHANGE_STACK_POLL_TIMEOUT or 30m)",
+		"copy-bits-start-timeout":   "Maximum time the copy-bits job may stay queued before giving up (default 5m)",
+		"no-telemetry":              "Don't count the migration in the local usage stats shown by bg-stats",
+		"probe":                     "Probe the routes of the app from the push of the new app until the old one is deleted, and report failed probes",
+		"probe-interval":            "Interval between route probes (default 100ms)",
+		"probe-deadline":            "Maximum time to probe the routes for (default 1h)",
+		"strict":                    "Refuse to change the stack when any pre-flight check raises a warning",
+		"resume":                    "Resume an interrupted stack change from the last state it reached",
+		"rollback":                  "Roll back an interrupted stack change, restoring the old app",
+		"dry-run":                   "Don't change anything, show the steps which would be run and the live configuration of the app the generated manifest doesn't capture",
+		"fast":                      "Change the stack of the app in place and restage it, which is quicker but incurs downtime",
+		"explain":                   "Print what each step does and why it is needed before running it",
+		"preserve":                  "Comma separated categories of configuration of the old app to reproduce on the new app, among env,services,features,routes,scale,metadata,sidecars (default all)",
+		"no-preserve":               "Comma separated categories of configuration of the old app not to reproduce on the new app",
+		"preserve-guid":             "Keep the GUID of the app: stage it on the new stack in a temporary app serving its routes, then copy the droplet back and restart the app",
+		"command-warn-after":        "Warn when a cf command run by the plugin takes longer than this (default 2m)",
+		"command-timeout":           "Give up on a cf command run by the plugin taking longer than this and roll back (default 1h)",
+		"venerable-suffix":          "Suffix appended to the name of the old app while the new app is built (default -venerable)",
+		"force":                     "Delete the app named like the old app will be, left by a previous failed stack change, instead of refusing to proceed, and change the stack of an app already on the new stack",
+		"output":                    "Format of the output: text, or json to print a json object per line for each completed step and for the outcome (default text)",
+		"start-timeout":             "Maximum time to wait for all the instances of the new app to be running before deleting the old app, rolling back otherwise (default 5m)",
+		"interactive":               "Ask for confirmation before deleting the old app once the new app runs, unless stdin is not a terminal",
+		"keep-venerable":            "Stop the old app instead of deleting it, to be able to go back to it by hand",
+		"app-start-timeout":         "Time the instances of the new app have to pass their health check when starting, e.g. 3m, instead of the timeout of the old app",
+		"strategy":                  "How the new app is built: push it from the manifest of the old app, or create it with the v3 API and copy the droplet of the old app (default push)",
+		"match-instances":           "Give the new app as many instances as the old one, rather than the number in its manifest, when preserving the scale (default true, pass --match-instances=false to disable)",
+		"verbose":                   "Print each cf command run by the plugin, including cf curl paths and bodies, to stderr, with the values of environment variables redacted",
+		"org":                       "Org of the apps, targeted for the duration of the command instead of the current one",
+		"space":                     "Space of the apps, targeted for the duration of the command instead of the current one",
+		"timeout":                   "Give up once the whole command has run this long, e.g. 1h, rolling back the stack change in progress (default none)",
+		"delete-venerable-timeout":  "Maximum time to wait for the old app to be gone once deleted, before warning it may still exist (default 1m)",
+		"download-droplet":          "Push the new app with the droplet of the old app, downloaded to the temp dir, rather than with an empty dir, and start it without staging it on the old stack; it is still restaged on the new stack",
+		"timings":                   "Print how long each step took once the stack change is over, to tell which ones are slow",
+		"health-check-type":         "Health check type of the web process of the new app until it runs, among http, port and process, e.g. process for flaky HTTP endpoints; the type of the old app is restored afterwards",
+		"quiet":                     "Print nothing but errors, to stderr, e.g. when the command is a step of a larger script; the exit code tells the outcome",
+		"manifest":                  "Path of the manifest to push the new app with instead of the one generated with cf create-app-manifest; it must hold the app",
+		"start-command":             "Start command of the web process of the new app, instead of the one of the old app",
+		"in-place":                  "Same as --fast: change the stack of the existing app and restage it, without renaming or pushing, with downtime",
+		"log-file":                  "Append a log of every step, cf command and error of the run to this file, each line with its time, level, run id and app",
+		"smoke-test":                "Shell command run once the new app runs, before the old app is deleted, with the routes of the app in $APP_ROUTES; the stack change is rolled back if it fails",
+		"tmp-dir":                   "Dir to create the temp dir holding the manifest in, instead of $TMPDIR, e.g. when it is small or mounted noexec",
+		"allow-downgrade":           "Allow moving apps to an older stack of the same family, e.g. from cflinuxfs4 to cflinuxfs3, which is otherwise refused",
+		"no-restart":                "Leave the new app stopped, for apps kept stopped on purpose: it is staged on the new stack without being started",
+		"snapshot":                  "Write the configuration of the old app (stack, buildpacks, env, services, routes, scale, metadata) as JSON to this file before changing anything; {app} is replaced by the app name",
+		"app-start-timeout-retries": "Number of times the new app is restarted, 10s apart, when its instances fail to start or to pass their health check, before rolling back (default 0)",
+		"result-file":               "Write the GUID, routes and stack of the new app as JSON to this file once the stack is changed, for automation; {app} is replaced by the app name",
+		"drain":                     "Stop the old app and wait this many seconds before deleting it, for the connections in flight to finish (default 0)",
+	}
+}
+
+// batchFlags registers the flags specific to the commands migrating several
+// apps on the given flag set.
+func batchFlags(flags *flag.FlagSet, options *changeStackOptions) {
+	flags.DurationVar(&options.AppTimeout, "app-timeout", 0, "roll back any app taking longer than this")
+	flags.BoolVar(&options.FailFast, "fail-fast", false, "stop at the first app which fails")
+	flags.IntVar(&options.Parallel, "parallel", 1, "number of apps migrated at the same time")
+}
+
+// batchUsageOptions documents the flags registered by batchFlags.
+func batchUsageOptions() map[string]string {
+	return map[string]string{
+		"app-timeout": "Roll back any app whose stack change takes longer than this, e.g. 20m, and go on with the next one",
+		"fail-fast":   "Don't change the stack of the remaining apps once the stack change of one failed",
+		"parallel":    "Number of apps whose stack is changed at the same time (default 1); the output of each is then reduced to a line per step prefixed with its name",
+	}
+}
+
+// withUsageOptions returns the union of the given usage options.
+func withUsageOptions(options ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, o := range options {
+		for name, usage := range o {
+			merged[name] = usage
+		}
+	}
+	return merged
+}
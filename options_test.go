@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// parseOptions parses the flags of bg-change-stack and validates the options.
+func parseOptions(args ...string) (changeStackOptions, error) {
+	flags := flag.NewFlagSet("bg-change-stack", flag.ContinueOnError)
+	options := changeStackFlags(flags)
+	batchFlags(flags, options)
+	err := flags.Parse(args)
+	if err == nil {
+		err = options.Validate()
+	}
+	return *options, err
+}
+
+// testOptions returns the options given by the flags, which must be valid.
+func testOptions(t *testing.T, args ...string) changeStackOptions {
+	t.Helper()
+	options, err := parseOptions(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+func TestValidateRejectsDropletStrategyWithoutManifestConfiguration(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--strategy", "droplet", "--no-preserve", "routes"}, "--strategy droplet must preserve routes"},
+		{[]string{"--strategy", "droplet", "--no-preserve", "env"}, "--strategy droplet must preserve env"},
+		{[]string{"--strategy", "droplet", "--no-preserve", "services"}, "--strategy droplet must preserve services"},
+		{[]string{"--strategy", "droplet", "--preserve", "routes,env"}, "--strategy droplet must preserve services"},
+		{[]string{"--strategy", "droplet", "--no-preserve", "scale,sidecars"}, ""},
+		{[]string{"--no-preserve", "routes"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			_, err := parseOptions(test.args...)
+			if test.err == "" && err != nil {
+				t.Fatalf("Validate() = %v, want no error", err)
+			}
+			if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+				t.Fatalf("Validate() = %v, want an error starting with %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsFlagsWithoutStepInPlan(t *testing.T) {
+	flags := [][]string{
+		{"--smoke-test", "true"},
+		{"--keep-venerable"},
+		{"--drain", "10"},
+		{"--interactive"},
+		{"--health-check-type", "process"},
+		{"--app-start-timeout", "3m"},
+		{"--app-start-timeout-retries", "2"},
+		{"--start-command", "./run"},
+	}
+	for _, plan := range []string{"--fast", "--in-place", "--preserve-guid"} {
+		for _, flag := range flags {
+			t.Run(plan+" "+strings.Join(flag, " "), func(t *testing.T) {
+				_, err := parseOptions(append([]string{plan}, flag...)...)
+				want := flag[0] + " can't be used with --fast, --in-place or --preserve-guid"
+				if err == nil || err.Error() != want {
+					t.Fatalf("Validate() = %v, want %q", err, want)
+				}
+			})
+		}
+	}
+	for _, flag := range flags {
+		t.Run(strings.Join(flag, " "), func(t *testing.T) {
+			_, err := parseOptions(flag...)
+			if err != nil {
+				t.Fatalf("Validate() = %v, want no error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin"
+)
+
+const (
+	textOutput = "text"
+	jsonOutput = "json"
+)
+
+// progressEvent is a line of the json output.
+type progressEvent struct {
+	App       string    `json:"app,omitempty"`
+	Step      string    `json:"step,omitempty"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Succeeded *int      `json:"succeeded,omitempty"`
+	Failed    *int      `json:"failed,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// progressReporter emits one json object per line on stdout for each step of
+// the stack change of an app, and one for its outcome, when the json output
+// was asked for. The events are written to the log file in any case.
+type progressReporter struct {
+	AppName string
+	JSON    bool
+	// Prefixed reports the events as text lines prefixed with the name of
+	// the app, for apps migrated in parallel whose output is hidden.
+	Prefixed bool
+}
+
+func newProgressReporter(appName string, options changeStackOptions) *progressReporter {
+	return &progressReporter{
+		AppName:  appName,
+		JSON:     options.Output == jsonOutput,
+		Prefixed: options.Output != jsonOutput && options.Parallel > 1,
+	}
+}
+
+func (reporter *progressReporter) StepCompleted(step Step) {
+	reporter.emit(progressEvent{Step: step.Name, Status: "completed"})
+}
+
+func (reporter *progressReporter) StepFailed(step Step, err error) {
+	reporter.emit(progressEvent{Step: step.Name, Status: "failed", Error: err.Error()})
+}
+
+// Skipped reports the stack change was not needed.
+func (reporter *progressReporter) Skipped(reason string) {
+	reporter.emit(progressEvent{Status: "skipped", Message: reason})
+}
+
+// Finished reports the outcome of the stack change.
+func (reporter *progressReporter) Finished(err error, rolledBack bool) {
+	event := progressEvent{Status: "succeeded"}
+	switch {
+	case err != nil && rolledBack:
+		event = progressEvent{Status: "rolled_back", Error: err.Error()}
+	case err != nil:
+		event = progressEvent{Status: "failed", Error: err.Error()}
+	}
+	reporter.emit(event)
+}
+
+func (reporter *progressReporter) emit(event progressEvent) {
+	event.App = reporter.AppName
+	logEvent(event)
+	switch {
+	case reporter.JSON:
+		emitEvent(event)
+	case reporter.Prefixed:
+		printPrefixed(event)
+	}
+}
+
+// stdout is the standard output the plugin started with, which the events
+// are written to even once os.Stdout is silenced.
+var stdout = os.Stdout
+
+// stdoutMutex keeps the lines written by concurrent stack changes from being
+// interleaved.
+var stdoutMutex sync.Mutex
+
+func emitEvent(event progressEvent) {
+	event.Timestamp = time.Now().UTC()
+	stdoutMutex.Lock()
+	defer stdoutMutex.Unlock()
+	err := json.NewEncoder(stdout).Encode(event)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to write progress:", err)
+	}
+}
+
+// printPrefixed prints the event as a line prefixed with the name of its app.
+func printPrefixed(event progressEvent) {
+	line := event.Status
+	if event.Step != "" {
+		line = event.Step + " " + line
+	}
+	if event.Error != "" {
+		line += ": " + event.Error
+	} else if event.Message != "" {
+		line += ": " + event.Message
+	}
+	stdoutMutex.Lock()
+	defer stdoutMutex.Unlock()
+	fmt.Fprintf(stdout, "[%s] %s\n", event.App, line)
+}
+
+// printPrefixedOutput prints the output of the stack change of an app to out,
+// each line prefixed with the name of the app.
+func printPrefixedOutput(out io.Writer, appName, output string) {
+	stdoutMutex.Lock()
+	defer stdoutMutex.Unlock()
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fmt.Fprintf(out, "[%s] %s\n", appName, line)
+	}
+}
+
+// emitSummary reports the outcome of the stack change of several apps.
+func emitSummary(results []changeStackResult) {
+	failed := failedCount(results)
+	succeeded := len(results) - failed
+	status := "succeeded"
+	if failed > 0 {
+		status = "failed"
+	}
+	emitEvent(progressEvent{Status: status, Succeeded: &succeeded, Failed: &failed})
+}
+
+// errorOutput is where errors are printed, stdout unless --quiet is passed.
+var errorOutput io.Writer = os.Stdout
+
+func printError(err error) {
+	fmt.Fprintln(errorOutput, "error:", err)
+}
+
+// silenceOutput discards everything printed to stdout, for --quiet, errors
+// being printed to stderr instead.
+func silenceOutput() error {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	errorOutput = os.Stderr
+	os.Stdout = devNull
+	return nil
+}
+
+// quietConnection runs every cf command without terminal output, so only the
+// json progress, or nothing with --quiet, is written to stdout.
+type quietConnection struct {
+	plugin.CliConnection
+}
+
+func (conn quietConnection) CliCommand(args ...string) ([]string, error) {
+	return conn.CliConnection.CliCommandWithoutTerminalOutput(args...)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/contraband/autopilot/rewind"
+)
+
+// Step is a single step of a Plan. Reverse, when set, is run if Forward fails
+// and should undo what the previous steps did, as in rewind.Action.
+type Step struct {
+	Name        string
+	Description string
+	// Rationale explains why the step is needed.
+	Rationale string
+	Forward   func() error
+	Reverse   func() error
+	// Optional steps only print a warning when they fail instead of
+	// aborting the plan.
+	Optional bool
+	// State, when set, is the state the operation reaches once the step
+	// completed.
+	State MigrationState
+}
+
+// Plan describes the ordered steps of an operation as data, so it can be
+// inspected before being compiled to rewind.Actions and executed.
+type Plan struct {
+	Steps                []Step
+	RewindFailureMessage string
+	// CutoverStep is the name of the step from which the routes of the app
+	// may be affected.
+	CutoverStep string
+	// StepDone, when set, is called after each step which completed.
+	StepDone func(step Step)
+	// StepFailed, when set, is called after each step which failed.
+	StepFailed func(step Step, err error)
+	// Explain prints the description and rationale of each step before
+	// running it.
+	Explain bool
+	// Output is where explanations and warnings are printed, stdout if
+	// nil.
+	Output io.Writer
+
+	// Timings are the durations of the steps run, in order.
+	Timings []StepTiming
+
+	rolledBack bool
+	// rollbackAttempted tells whether the step which failed had a reverse
+	// action, which was run.
+	rollbackAttempted bool
+	// failure is the error of the step which failed, if any.
+	failure error
+}
+
+// StepTiming is how long a step took to run, whether it succeeded or not.
+type StepTiming struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Add appends steps to the plan.
+func (plan *Plan) Add(steps ...Step) {
+	plan.Steps = append(plan.Steps, steps...)
+}
+
+// AddIf appends steps to the plan when the condition holds.
+func (plan *Plan) AddIf(condition bool, steps ...Step) {
+	if condition {
+		plan.Add(steps...)
+	}
+}
+
+// InsertBefore inserts steps before the named step, or appends them if the
+// plan has no such step.
+func (plan *Plan) InsertBefore(name string, steps ...Step) {
+	for i, step := range plan.Steps {
+		if step.Name == name {
+			rest := append(append([]Step{}, steps...), plan.Steps[i:]...)
+			plan.Steps = append(plan.Steps[:i], rest...)
+			return
+		}
+	}
+	plan.Add(steps...)
+}
+
+// Replace replaces the named step with the given steps, removing it when there
+// are none.
+func (plan *Plan) Replace(name string, steps ...Step) {
+	for i, step := range plan.Steps {
+		if step.Name == name {
+			rest := append(append([]Step{}, steps...), plan.Steps[i+1:]...)
+			plan.Steps = append(plan.Steps[:i], rest...)
+			return
+		}
+	}
+}
+
+// SkipThrough removes the steps up to and including the named step, to resume
+// an operation after it.
+func (plan *Plan) SkipThrough(name string) error {
+	for i, step := range plan.Steps {
+		if step.Name == name {
+			plan.Steps = plan.Steps[i+1:]
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown step %s", name)
+}
+
+// Descriptions returns the descriptions of the steps in order.
+func (plan Plan) Descriptions() []string {
+	descriptions := make([]string, 0, len(plan.Steps))
+	for _, step := range plan.Steps {
+		descriptions = append(descriptions, step.Description)
+	}
+	return descriptions
+}
+
+// StepNames returns the names of the steps in order.
+func (plan Plan) StepNames() []string {
+	names := make([]string, 0, len(plan.Steps))
+	for _, step := range plan.Steps {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+// Compile turns the plan into rewind.Actions ready to be executed. Once the
+// context is done, the next step fails with the error of the context instead
+// of running, which rolls back what was done. When rolling back fails, the
+// error follows RewindFailureMessage and tells which step failed and why, as
+// what is left to clean up by hand depends on both.
+func (plan *Plan) Compile(ctx context.Context) rewind.Actions {
+	actions := make([]rewind.Action, 0, len(plan.Steps))
+	for _, step := range plan.Steps {
+		actions = append(actions, rewind.Action{
+			Forward:         plan.forward(ctx, step),
+			ReversePrevious: plan.reverse(step),
+		})
+	}
+	return rewind.Actions{
+		Actions:              actions,
+		RewindFailureMessage: plan.RewindFailureMessage,
+	}
+}
+
+// Execute compiles and executes the plan.
+func (plan *Plan) Execute(ctx context.Context) error {
+	return plan.Compile(ctx).Execute()
+}
+
+// RolledBack tells whether the plan failed and what was done was successfully
+// undone.
+func (plan *Plan) RolledBack() bool {
+	return plan.rolledBack
+}
+
+// RollbackAttempted tells whether the plan failed and an attempt was made at
+// undoing what was done, the step which failed having a reverse action.
+func (plan *Plan) RollbackAttempted() bool {
+	return plan.rollbackAttempted
+}
+
+func (plan *Plan) printf(format string, args ...interface{}) {
+	out := plan.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	fmt.Fprintf(out, format, args...)
+}
+
+func (plan *Plan) forward(ctx context.Context, step Step) func() error {
+	return func() error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s not run: %s", step.Name, ctx.Err())
+		}
+		if plan.Explain {
+			plan.printf("\n==> %s\n    why: %s\n", step.Description, step.Rationale)
+		}
+		start := time.Now()
+		err := step.Forward()
+		plan.Timings = append(plan.Timings, StepTiming{Name: step.Name, Duration: time.Since(start)})
+		if err != nil && err == ctx.Err() {
+			// A wait of the step was cut short.
+			err = fmt.Errorf("%s interrupted: %s", step.Name, err)
+		}
+		if err != nil && step.Optional {
+			plan.printf("warning: optional step %s failed: %s\n", step.Name, err)
+			err = nil
+		}
+		if err == nil && plan.StepDone != nil {
+			plan.StepDone(step)
+		}
+		if err != nil {
+			plan.failure = err
+		}
+		if err != nil && plan.StepFailed != nil {
+			plan.StepFailed(step, err)
+		}
+		return err
+	}
+}
+
+func (plan *Plan) reverse(step Step) func() error {
+	if step.Reverse == nil {
+		return nil
+	}
+	return func() error {
+		plan.rollbackAttempted = true
+		err := step.Reverse()
+		plan.rolledBack = err == nil
+		if err != nil {
+			return fmt.Errorf("rolling back after step %s failed with \"%s\" failed: %s", step.Name, plan.failure, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Preflight collects the warnings raised by the checks run before changing
+// the stack of an app. Warnings don't prevent the change unless in strict
+// mode.
+type Preflight struct {
+	Warnings []string
+	// Output is where the warnings are printed, stdout if nil.
+	Output io.Writer
+}
+
+func (preflight *Preflight) Warn(format string, args ...interface{}) {
+	preflight.Warnings = append(preflight.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Result prints the collected warnings and, in strict mode, turns them into
+// an error.
+func (preflight *Preflight) Result(strict bool) error {
+	out := preflight.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	for _, warning := range preflight.Warnings {
+		fmt.Fprintln(out, "warning:", warning)
+	}
+	if strict && len(preflight.Warnings) > 0 {
+		return fmt.Errorf("%d pre-flight warning(s) in strict mode, not changing stack", len(preflight.Warnings))
+	}
+	return nil
+}
+
+// alreadyOnStack is returned by runPreflight when the app is already on the
+// stack to change to, in which case there is nothing to do.
+type alreadyOnStack string
+
+func (stack alreadyOnStack) Error() string {
+	return fmt.Sprintf("app already on stack '%s', nothing to do", string(stack))
+}
+
+func isAlreadyOnStack(err error) bool {
+	_, ok := err.(alreadyOnStack)
+	return ok
+}
+
+// stackFamilies lists the known stacks of each family from the oldest to the
+// newest, to tell downgrades.
+var stackFamilies = [][]string{
+	{"cflinuxfs2", "cflinuxfs3", "cflinuxfs4"},
+	{"windows2012R2", "windows2016", "windows"},
+}
+
+// stackRank returns the family of a known stack and its rank in it.
+func stackRank(stack string) (family, rank int, known bool) {
+	for family, stacks := range stackFamilies {
+		for rank, s := range stacks {
+			if s == stack {
+				return family, rank, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// checkDowngrade refuses to move an app to an older stack of the same family
+// unless allowed. Unknown stacks can't be compared and only raise a warning.
+func checkDowngrade(preflight *Preflight, appName, oldStackName, newStackName string, allowDowngrade bool) error {
+	oldFamily, oldRank, oldKnown := stackRank(oldStackName)
+	newFamily, newRank, newKnown := stackRank(newStackName)
+	switch {
+	case !oldKnown || !newKnown:
+		preflight.Warn("can't tell whether moving app %s from stack %s to %s is a downgrade, not knowing both stacks", appName, oldStackName, newStackName)
+	case oldFamily == newFamily && newRank < oldRank && !allowDowngrade:
+		return fmt.Errorf("moving app %s from stack %s to %s is a downgrade, pass --allow-downgrade to proceed", appName, oldStackName, newStackName)
+	}
+	return nil
+}
+
+// stackOS tells the operating system of the stack, linux or windows, from its
+// name and description, or "" if neither tells.
+func stackOS(stack Stack) string {
+	for _, s := range []string{stack.Name, stack.Description} {
+		s = strings.ToLower(s)
+		switch {
+		case strings.Contains(s, "windows"):
+			return "windows"
+		case strings.Contains(s, "linux") || strings.Contains(s, "ubuntu"):
+			return "linux"
+		}
+	}
+	return ""
+}
+
+// checkStacksCompatible refuses to move an app between stacks of different
+// operating systems: the copied bits were built for the old one, the app
+// couldn't be staged or started on the new one.
+func checkStacksCompatible(appName string, oldStack, newStack Stack) error {
+	oldOS, newOS := stackOS(oldStack), stackOS(newStack)
+	if oldOS != "" && newOS != "" && oldOS != newOS {
+		return fmt.Errorf("app %s can't move from %s stack %s to %s stack %s, its bits were built for %s", appName, oldOS, oldStack.Name, newOS, newStack.Name, oldOS)
+	}
+	return nil
+}
+
+// The checks below are run by runPreflight, and by bg-change-stack-check to
+// tell whether an app is ready for its stack to be changed.
+
+func checkVenerableName(venerableName string) error {
+	if len(venerableName) > maxAppNameLength {
+		return fmt.Errorf("app name '%s' would be longer than %d characters, pass a shorter --venerable-suffix", venerableName, maxAppNameLength)
+	}
+	return nil
+}
+
+func checkNotDocker(appName string, app App) error {
+	if app.Lifecycle.Type == "docker" {
+		return fmt.Errorf("app %s runs a Docker image, stacks don't apply to Docker apps", appName)
+	}
+	return nil
+}
+
+func checkStaged(appRepo *ApplicationRepo, appName, appGuid string) error {
+	staged, err := appRepo.HasCurrentDroplet(appGuid)
+	if err != nil {
+		return err
+	}
+	if !staged {
+		return fmt.Errorf("app %s has no droplet as it was never staged successfully, there is nothing to copy to a new app; stage it first, e.g. with `cf restage %s`", appName, appName)
+	}
+	return nil
+}
+
+func checkNoActiveDeployment(appRepo *ApplicationRepo, appName, appGuid string) error {
+	deployments, err := appRepo.CountActiveDeployments(appGuid)
+	if err != nil {
+		return err
+	}
+	if deployments > 0 {
+		return fmt.Errorf("app %s has an active deployment, wait for it to finish", appName)
+	}
+	return nil
+}
+
+func checkRunningTasks(preflight *Preflight, appRepo *ApplicationRepo, appName, appGuid string) error {
+	tasks, err := appRepo.CountRunningTasks(appGuid)
+	if err != nil {
+		return err
+	}
+	if tasks > 0 {
+		preflight.Warn("app %s has %d running task(s), which will be killed when the old app is deleted", appName, tasks)
+	}
+	return nil
+}
+
+// runPreflight checks the app is in a good shape for its stack to be
+// changed, before anything is modified.
+func runPreflight(appRepo *ApplicationRepo, appName string, newStackName string, options changeStackOptions) error {
+	preflight := &Preflight{Output: appRepo.output()}
+
+	exists, err := appRepo.DoesAppExist(appName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("app '%s' not found in current space", appName)
+	}
+
+	venerableName := venerableAppName(appName, options.VenerableSuffix)
+	err = checkVenerableName(venerableName)
+	if err != nil {
+		return err
+	}
+
+	exists, err = appRepo.StackExists(newStackName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		stacks, err := appRepo.GetStackNames()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("stack '%s' not found, available stacks: %s", newStackName, strings.Join(stacks, ", "))
+	}
+
+	appGuid, err := appRepo.GetAppGuid(appName)
+	if err != nil {
+		return err
+	}
+	app, err := appRepo.GetApp(appGuid)
+	if err != nil {
+		return err
+	}
+	err = checkNotDocker(appName, app)
+	if err != nil {
+		return err
+	}
+	if app.Lifecycle.Data.Stack == newStackName && !options.Force {
+		return alreadyOnStack(newStackName)
+	}
+	if options.Output != jsonOutput {
+		appRepo.printf("app %s will migrate from stack %s to %s\n", appName, app.Lifecycle.Data.Stack, newStackName)
+	}
+	// The old stack may have been removed, its name then tells its
+	// operating system.
+	oldStack, err := appRepo.GetStack(app.Lifecycle.Data.Stack)
+	if err != nil {
+		return err
+	}
+	newStack, err := appRepo.GetStack(newStackName)
+	if err != nil {
+		return err
+	}
+	err = checkStacksCompatible(appName, oldStack, newStack)
+	if err != nil {
+		return err
+	}
+	err = checkDowngrade(preflight, appName, app.Lifecycle.Data.Stack, newStackName, options.AllowDowngrade)
+	if err != nil {
+		return err
+	}
+	err = checkStaged(appRepo, appName, appGuid)
+	if err != nil {
+		return err
+	}
+	err = checkNoActiveDeployment(appRepo, appName, appGuid)
+	if err != nil {
+		return err
+	}
+	err = checkRunningTasks(preflight, appRepo, appName, appGuid)
+	if err != nil {
+		return err
+	}
+
+	err = preflight.Result(options.Strict)
+	if err != nil {
+		return err
+	}
+	switch {
+	case options.Fast:
+		return nil
+	case options.PreserveGUID:
+		return removeStaleApp(appRepo, appName, temporaryAppName(appName), options)
+	}
+	return removeStaleApp(appRepo, appName, venerableName, options)
+}
+
+// removeStaleApp makes sure no app is in the way of the app the stack change
+// renames the app to, or of its temporary app. Such an app is likely left by a
+// previous stack change which failed, so it is only deleted with --force.
+func removeStaleApp(appRepo *ApplicationRepo, appName, staleName string, options changeStackOptions) error {
+	exists, err := appRepo.DoesAppExist(staleName)
+	if err != nil || !exists {
+		return err
+	}
+	if !options.Force {
+		return fmt.Errorf(
+			"app '%s' already exists, a previous stack change of app '%s' likely failed; check both apps, then delete it or run again with --force to delete it",
+			staleName, appName,
+		)
+	}
+	if options.DryRun {
+		appRepo.printf("app %s left by a previous stack change which likely failed would be deleted\n", staleName)
+		return nil
+	}
+	appRepo.printf("deleting app %s left by a previous stack change which likely failed\n", staleName)
+	return appRepo.DeleteApplication(staleName)
+}
+
+type Stack struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// GetStack returns the stack with the given name, with only its name if there
+// is no such stack.
+func (repo *ApplicationRepo) GetStack(stackName string) (Stack, error) {
+	var stacks struct {
+		Resources []Stack `json:"resources"`
+	}
+	err := repo.curl(&stacks, fmt.Sprintf("/v3/stacks?names=%s", url.QueryEscape(stackName)))
+	if err != nil || len(stacks.Resources) == 0 {
+		return Stack{Name: stackName}, err
+	}
+	return stacks.Resources[0], nil
+}
+
+func (repo *ApplicationRepo) StackExists(stackName string) (bool, error) {
+	var stacks struct {
+		Resources []struct {
+			Name string `json:"name"`
+		} `json:"resources"`
+	}
+	err := repo.curl(&stacks, fmt.Sprintf("/v3/stacks?names=%s", url.QueryEscape(stackName)))
+	return len(stacks.Resources) > 0, err
+}
+
+func (repo *ApplicationRepo) GetStackNames() ([]string, error) {
+	var stacks []struct {
+		Name string `json:"name"`
+	}
+	err := repo.curlAll(&stacks, "/v3/stacks?per_page=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(stacks))
+	for _, stack := range stacks {
+		names = append(names, stack.Name)
+	}
+	return names, nil
+}
+
+func (repo *ApplicationRepo) CountActiveDeployments(appGuid string) (int, error) {
+	var deployments struct {
+		Pagination struct {
+			TotalResults int `json:"total_results"`
+		} `json:"pagination"`
+	}
+	err := repo.curl(&deployments, fmt.Sprintf("/v3/deployments?app_guids=%s&status_values=ACTIVE", url.QueryEscape(appGuid)))
+	return deployments.Pagination.TotalResults, err
+}
+
+func (repo *ApplicationRepo) CountRunningTasks(appGuid string) (int, error) {
+	var tasks struct {
+		Pagination struct {
+			TotalResults int `json:"total_results"`
+		} `json:"pagination"`
+	}
+	err := repo.curl(&tasks, fmt.Sprintf("/v3/apps/%s/tasks?states=RUNNING", url.PathEscape(appGuid)))
+	return tasks.Pagination.TotalResults, err
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckVenerableName(t *testing.T) {
+	tests := []struct {
+		length int
+		valid  bool
+	}{
+		{63, true},
+		{64, true},
+		{maxAppNameLength, true},
+		{maxAppNameLength + 1, false},
+	}
+	for _, test := range tests {
+		err := checkVenerableName(strings.Repeat("a", test.length))
+		if (err == nil) != test.valid {
+			t.Errorf("checkVenerableName() of a %d characters name = %v, want valid: %t", test.length, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The categories of configuration of the old app which are reproduced on the
+// new app, on top of what the generated manifest captures.
+const (
+	preserveEnv      = "env"
+	preserveServices = "services"
+	preserveFeatures = "features"
+	preserveRoutes   = "routes"
+	preserveScale    = "scale"
+	preserveMetadata = "metadata"
+	preserveSidecars = "sidecars"
+)
+
+var preserveCategories = []string{preserveEnv, preserveServices, preserveFeatures, preserveRoutes, preserveScale, preserveMetadata, preserveSidecars}
+
+// preservedCategories returns the set of categories to preserve: all of them
+// unless restricted by preserve, minus those in noPreserve. Both are comma
+// separated lists.
+func preservedCategories(preserve, noPreserve string) (map[string]bool, error) {
+	preserved := map[string]bool{}
+	if preserve == "" {
+		for _, category := range preserveCategories {
+			preserved[category] = true
+		}
+	}
+	for _, category := range splitList(preserve) {
+		if !isPreserveCategory(category) {
+			return nil, fmt.Errorf("unknown category '%s' in --preserve, expected some of %s", category, strings.Join(preserveCategories, ","))
+		}
+		preserved[category] = true
+	}
+	for _, category := range splitList(noPreserve) {
+		if !isPreserveCategory(category) {
+			return nil, fmt.Errorf("unknown category '%s' in --no-preserve, expected some of %s", category, strings.Join(preserveCategories, ","))
+		}
+		delete(preserved, category)
+	}
+	return preserved, nil
+}
+
+func isPreserveCategory(category string) bool {
+	for _, c := range preserveCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// CopyEnv sets the user-provided environment variables of the source app
+// which the app lacks or has a different value for.
+func (repo *ApplicationRepo) CopyEnv(sourceAppGuid, appGuid string) error {
+	sourceEnv, err := repo.GetAppEnv(sourceAppGuid)
+	if err != nil {
+		return err
+	}
+	env, err := repo.GetAppEnv(appGuid)
+	if err != nil {
+		return err
+	}
+
+	missing := map[string]string{}
+	for name, value := range sourceEnv {
+		if isSystemEnvVar(name) {
+			continue
+		}
+		if current, ok := env[name]; !ok || current != value {
+			missing[name] = value
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	repo.printf("setting %d environment variable(s) missing from the manifest\n", len(missing))
+	body := map[string]interface{}{"var": missing}
+	return repo.curlWithBody(nil, "PATCH", fmt.Sprintf("/v3/apps/%s/environment_variables", url.PathEscape(appGuid)), body)
+}
+
+// isSystemEnvVar tells whether the variable is provided by the platform, in
+// which case it can't be set on an app.
+func isSystemEnvVar(name string) bool {
+	return name == "PORT" || strings.HasPrefix(name, "VCAP_") || strings.HasPrefix(name, "CF_INSTANCE_")
+}
+
+// BindServices binds to the app the service instances bound to the source app
+// which it isn't bound to yet, and returns those it bound, even when failing
+// to bind one of them.
+func (repo *ApplicationRepo) BindServices(sourceAppGuid, appGuid, appName string) ([]string, error) {
+	sourceServices, err := repo.GetBoundServices(sourceAppGuid)
+	if err != nil {
+		return nil, err
+	}
+	services, err := repo.GetBoundServices(appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	bound := map[string]bool{}
+	for _, service := range services {
+		bound[service] = true
+	}
+	var newlyBound []string
+	for _, service := range sourceServices {
+		if bound[service] {
+			continue
+		}
+		_, err := repo.conn.CliCommand("bind-service", appName, service)
+		if err != nil {
+			return newlyBound, err
+		}
+		newlyBound = append(newlyBound, service)
+	}
+	return newlyBound, nil
+}
+
+// UnbindServices unbinds the service instances from the app.
+func (repo *ApplicationRepo) UnbindServices(appName string, services []string) error {
+	for _, service := range services {
+		_, err := repo.conn.CliCommand("unbind-service", appName, service)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type AppFeature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+func (repo *ApplicationRepo) GetAppFeatures(appGuid string) ([]AppFeature, error) {
+	var features []AppFeature
+	err := repo.curlAll(&features, fmt.Sprintf("/v3/apps/%s/features", url.PathEscape(appGuid)))
+	return features, err
+}
+
+// CopyFeatures gives the app features such as ssh or revisions the state
+// they have on the source app.
+func (repo *ApplicationRepo) CopyFeatures(sourceAppGuid, appGuid string) error {
+	sourceFeatures, err := repo.GetAppFeatures(sourceAppGuid)
+	if err != nil {
+		return err
+	}
+	features, err := repo.GetAppFeatures(appGuid)
+	if err != nil {
+		return err
+	}
+
+	enabled := map[string]bool{}
+	for _, feature := range features {
+		enabled[feature.Name] = feature.Enabled
+	}
+	sort.Slice(sourceFeatures, func(i, j int) bool { return sourceFeatures[i].Name < sourceFeatures[j].Name })
+	for _, feature := range sourceFeatures {
+		if current, ok := enabled[feature.Name]; !ok || current == feature.Enabled {
+			continue
+		}
+		body := map[string]interface{}{"enabled": feature.Enabled}
+		err := repo.curlWithBody(nil, "PATCH", fmt.Sprintf("/v3/apps/%s/features/%s", url.PathEscape(appGuid), url.PathEscape(feature.Name)), body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppMetadata holds the labels and annotations of an app.
+type AppMetadata struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func (repo *ApplicationRepo) GetAppMetadata(appGuid string) (AppMetadata, error) {
+	var app struct {
+		Metadata AppMetadata `json:"metadata"`
+	}
+	err := repo.curl(&app, fmt.Sprintf("/v3/apps/%s", url.PathEscape(appGuid)))
+	return app.Metadata, err
+}
+
+// SetAppMetadata sets the labels and annotations on the app, leaving its
+// others alone.
+func (repo *ApplicationRepo) SetAppMetadata(appGuid string, labels, annotations map[string]string) error {
+	if len(labels) == 0 && len(annotations) == 0 {
+		return nil
+	}
+	body := map[string]interface{}{
+		"metadata": AppMetadata{Labels: labels, Annotations: annotations},
+	}
+	return repo.curlWithBody(nil, "PATCH", fmt.Sprintf("/v3/apps/%s", url.PathEscape(appGuid)), body)
+}
+
+// CopyMetadata sets the labels and annotations of the source app on the app.
+func (repo *ApplicationRepo) CopyMetadata(sourceAppGuid, appGuid string) error {
+	metadata, err := repo.GetAppMetadata(sourceAppGuid)
+	if err != nil {
+		return err
+	}
+	return repo.SetAppMetadata(appGuid, metadata.Labels, metadata.Annotations)
+}
+
+// Sidecar is a process run alongside the processes of the given types of an
+// app, in the same containers.
+type Sidecar struct {
+	Name         string   `json:"name"`
+	Command      string   `json:"command"`
+	ProcessTypes []string `json:"process_types"`
+	MemoryInMB   *int     `json:"memory_in_mb,omitempty"`
+	// Origin is user for the sidecars created through the API or the
+	// manifest, buildpack for those the buildpack adds when staging.
+	Origin string `json:"origin,omitempty"`
+}
+
+func (repo *ApplicationRepo) GetSidecars(appGuid string) ([]Sidecar, error) {
+	var sidecars []Sidecar
+	err := repo.curlAll(&sidecars, fmt.Sprintf("/v3/apps/%s/sidecars?per_page=5000", url.PathEscape(appGuid)))
+	return sidecars, err
+}
+
+// CopySidecars creates on the app the sidecars of the source app which it
+// lacks. Those added by the buildpack are left for the staging of the app to
+// add.
+func (repo *ApplicationRepo) CopySidecars(sourceAppGuid, appGuid string) error {
+	sourceSidecars, err := repo.GetSidecars(sourceAppGuid)
+	if err != nil {
+		return err
+	}
+	sidecars, err := repo.GetSidecars(appGuid)
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	for _, sidecar := range sidecars {
+		existing[sidecar.Name] = true
+	}
+	for _, sidecar := range sourceSidecars {
+		if sidecar.Origin == "buildpack" || existing[sidecar.Name] {
+			continue
+		}
+		sidecar.Origin = ""
+		err := repo.curlWithBody(nil, "POST", fmt.Sprintf("/v3/apps/%s/sidecars", url.PathEscape(appGuid)), sidecar)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyRoutes checks the app has all the routes of the source app.
+func (repo *ApplicationRepo) VerifyRoutes(sourceAppGuid, appGuid string) error {
+	sourceRoutes, err := repo.GetAppRoutes(sourceAppGuid)
+	if err != nil {
+		return err
+	}
+	routes, err := repo.GetAppRoutes(appGuid)
+	if err != nil {
+		return err
+	}
+
+	mapped := map[string]bool{}
+	for _, route := range routes {
+		mapped[route.GUID] = true
+	}
+	var missing []string
+	for _, route := range sourceRoutes {
+		if !mapped[route.GUID] {
+			missing = append(missing, route.URL)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("new app is missing route(s) %s of the old app", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+func temporaryAppName(appName string) string {
+	return fmt.Sprintf("%s-new-stack", appName)
+}
+
+// preserveGUIDChangeStackActions changes the stack of the app while keeping
+// its GUID. A temporary app is built from the bits of the app on the new
+// stack and started on the same routes, so it serves traffic while the
+// droplet it staged is copied back onto the app, which is then restarted on
+// the new stack. Unlike the rename-based flow, the app itself is restarted in
+// place: its instances are all down for a moment, the temporary app alone
+// serving its routes meanwhile.
+func preserveGUIDChangeStackActions(ctx context.Context, appRepo *ApplicationRepo, appName string, newStackName string, options changeStackOptions) Plan {
+	tmpAppName := temporaryAppName(appName)
+	var appGuid, tmpAppGuid string
+	var oldDroplet Droplet
+	var oldStackName string
+	// restarted tells whether the app was restarted, its instances only
+	// running the new stack and droplet once restarted.
+	var restarted bool
+
+	deleteTemporaryApp := func() error {
+		return appRepo.DeleteApplication(tmpAppName)
+	}
+	// Puts the app back on its old stack and droplet before deleting the
+	// temporary app. The app is only restarted if it was, its instances
+	// otherwise still running the old droplet.
+	restoreApp := func() error {
+		err := appRepo.AssignTargetStack(ctx, appGuid, oldStackName)
+		if err != nil {
+			return err
+		}
+		err = appRepo.SetCurrentDroplet(appGuid, oldDroplet.GUID)
+		if err != nil {
+			return err
+		}
+		if restarted {
+			err = appRepo.RestartApplication(appName)
+			if err != nil {
+				return err
+			}
+		}
+		return deleteTemporaryApp()
+	}
+
+	plan := Plan{
+		RewindFailureMessage: "Oh no. Something's gone wrong. I've tried to roll back but you should check to see if everything is OK.",
+		CutoverStep:          "restage_temporary",
+	}
+	plan.Add(
+		Step{
+			Name:        "create_manifest",
+			Description: fmt.Sprintf("create the manifest of app %s", appName),
+			Rationale:   "the temporary app is pushed with the configuration of the app, as captured by its manifest",
+			Forward: func() error {
+				return appRepo.CreateManifest(appName)
+			},
+		},
+		Step{
+			Name:        "check_manifest",
+			Description: "check the manifest captured the configuration of the app",
+			Rationale:   "a manifest without configuration would start the temporary app with default settings",
+			Forward: func() error {
+				return appRepo.CheckManifestNotBlank(appName)
+			},
+		},
+		Step{
+			Name:        "touch_dir",
+			Description: "create a fake file to push",
+			Rationale:   "cf push needs something to upload, the real bits are copied from the app afterwards",
+			Forward: func() error {
+				return appRepo.TouchDir()
+			},
+		},
+		Step{
+			Name:        "capture_droplet",
+			Description: fmt.Sprintf("read the current stack and droplet of app %s", appName),
+			Rationale:   "the old stack and droplet are needed to roll back the app",
+			Forward: func() error {
+				var err error
+				appGuid, err = appRepo.GetAppGuid(appName)
+				if err != nil {
+					return err
+				}
+				app, err := appRepo.GetApp(appGuid)
+				if err != nil {
+					return err
+				}
+				oldStackName = app.Lifecycle.Data.Stack
+				oldDroplet, err = appRepo.GetCurrentDroplet(appGuid)
+				return err
+			},
+		},
+		Step{
+			Name:        "push",
+			Description: fmt.Sprintf("push temporary app %s without starting it", tmpAppName),
+			Rationale:   "the temporary app gets the routes of the app from the manifest, to serve them while the app restarts",
+			Forward: func() error {
+				return appRepo.PushApplication(tmpAppName)
+			},
+			// The push may have created the temporary app before failing,
+			// its name being free beforehand.
+			Reverse: deleteTemporaryApp,
+		},
+		Step{
+			Name:        "copy_bits",
+			Description: fmt.Sprintf("copy the bits of app %s to app %s", appName, tmpAppName),
+			Rationale:   "the temporary app must run the same code as the app",
+			Forward: func() error {
+				var err error
+				tmpAppGuid, err = appRepo.GetAppGuid(tmpAppName)
+				if err != nil {
+					return err
+				}
+				return copyBits(ctx, appRepo, appGuid, tmpAppGuid, tmpAppName, options)
+			},
+			Reverse: deleteTemporaryApp,
+		},
+		Step{
+			Name:        "change_temporary_stack",
+			Description: fmt.Sprintf("change the stack of app %s to %s", tmpAppName, newStackName),
+			Rationale:   "the stack only applies to the next staging of the temporary app",
+			Forward: func() error {
+				return appRepo.AssignTargetStack(ctx, tmpAppGuid, newStackName)
+			},
+			Reverse: deleteTemporaryApp,
+		},
+		Step{
+			Name:        "restage_temporary",
+			Description: fmt.Sprintf("stage app %s on stack %s and start it on the routes of app %s", tmpAppName, newStackName, appName),
+			Rationale:   "staging on the new stack in the temporary app checks the app builds there, and starts it on the routes",
+			Forward: func() error {
+				appRepo.printf("\n")
+				return appRepo.RestageApplication(tmpAppName)
+			},
+			Reverse: deleteTemporaryApp,
+		},
+		Step{
+			Name:        "change_stack",
+			Description: fmt.Sprintf("change the stack of app %s to %s", appName, newStackName),
+			Rationale:   "the app must be on the new stack to run the droplet staged on it",
+			Forward: func() error {
+				return appRepo.AssignTargetStack(ctx, appGuid, newStackName)
+			},
+			Reverse: restoreApp,
+		},
+		Step{
+			Name:        "copy_droplet",
+			Description: fmt.Sprintf("copy the droplet staged by app %s to app %s", tmpAppName, appName),
+			Rationale:   "reusing the droplet of the temporary app avoids staging the app itself, so its GUID is kept",
+			Forward: func() error {
+				tmpDroplet, err := appRepo.GetCurrentDroplet(tmpAppGuid)
+				if err != nil {
+					return err
+				}
+				droplet, err := appRepo.CopyDroplet(ctx, tmpDroplet.GUID, appGuid)
+				if err != nil {
+					return err
+				}
+				return appRepo.SetCurrentDroplet(appGuid, droplet.GUID)
+			},
+			Reverse: restoreApp,
+		},
+		Step{
+			Name:        "restart",
+			Description: fmt.Sprintf("restart app %s on stack %s", appName, newStackName),
+			Rationale:   "restarting runs the new droplet, the temporary app serving the routes meanwhile",
+			Forward: func() error {
+				appRepo.printf("\n")
+				// A failed restart may have stopped the app.
+				restarted = true
+				return appRepo.RestartApplication(appName)
+			},
+			Reverse: restoreApp,
+		},
+		Step{
+			Name:        "delete",
+			Description: fmt.Sprintf("delete temporary app %s", tmpAppName),
+			Rationale:   "once the app runs on the new stack, the temporary app is no longer needed",
+			Forward:     deleteTemporaryApp,
+		},
+	)
+	return plan
+}
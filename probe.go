@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RouteProbe repeatedly requests the routes of an app while its stack is being
+// changed, to give evidence that it stayed available.
+type RouteProbe struct {
+	Interval time.Duration
+	Deadline time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	report ProbeReport
+}
+
+type ProbeReport struct {
+	Probes   int
+	Failures int
+	// Downtime is the cumulated time between a round of probes in which a
+	// route failed and the round before it, however many routes failed.
+	Downtime time.Duration
+	Duration time.Duration
+}
+
+func (report ProbeReport) String() string {
+	return fmt.Sprintf(
+		"%d probes over %s, %d failed, unavailable for %s",
+		report.Probes, report.Duration.Round(time.Millisecond), report.Failures, report.Downtime.Round(time.Millisecond),
+	)
+}
+
+// Start probes the given URLs in the background until Stop is called
+// or the deadline of the probe is reached.
+func (probe *RouteProbe) Start(urls []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), probe.Deadline)
+	probe.cancel = cancel
+	client := &http.Client{Timeout: time.Second}
+
+	probe.wg.Add(1)
+	go func() {
+		defer probe.wg.Done()
+		start := time.Now()
+		last := start
+		ticker := time.NewTicker(probe.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				probe.report.Duration = time.Since(start)
+				return
+			case <-ticker.C:
+			}
+			down := false
+			for _, u := range urls {
+				probe.report.Probes++
+				if !probeURL(ctx, client, u) && ctx.Err() == nil {
+					probe.report.Failures++
+					down = true
+				}
+			}
+			if down {
+				probe.report.Downtime += time.Since(last)
+			}
+			last = time.Now()
+		}
+	}()
+}
+
+// Stop stops probing and returns what was observed.
+func (probe *RouteProbe) Stop() ProbeReport {
+	if probe.cancel == nil {
+		return probe.report
+	}
+	probe.cancel()
+	probe.wg.Wait()
+	return probe.report
+}
+
+// probeURL tells whether the route answered with a response of the app rather
+// than an error of the router.
+func probeURL(ctx context.Context, client *http.Client, u string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500 && resp.Header.Get("X-Cf-Routererror") == ""
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProbeCountsDowntimeOncePerRound(t *testing.T) {
+	down := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	first, second := httptest.NewServer(down), httptest.NewServer(down)
+	defer first.Close()
+	defer second.Close()
+
+	probe := &RouteProbe{Interval: 10 * time.Millisecond, Deadline: time.Minute}
+	probe.Start([]string{first.URL, second.URL})
+	time.Sleep(200 * time.Millisecond)
+	report := probe.Stop()
+
+	// Probes cut short by Stop don't fail.
+	if report.Failures == 0 || report.Failures < report.Probes-2 {
+		t.Fatalf("%d of %d probes failed, want all of them", report.Failures, report.Probes)
+	}
+	if report.Downtime > report.Duration {
+		t.Errorf("unavailable for %s over %s of probing, each failed route counted", report.Downtime, report.Duration)
+	}
+	if report.Downtime < report.Duration/2 {
+		t.Errorf("unavailable for %s over %s of probing, all of it down", report.Downtime, report.Duration)
+	}
+}
+
+func TestProbeURLsLeavesOutTCPAndInternalRoutes(t *testing.T) {
+	cf := newFakeCF()
+	cf.curl = func(method, path string) (int, string) {
+		if path == "/v3/domains/internal-domain-guid" {
+			return http.StatusOK, `{"guid":"internal-domain-guid","internal":true}`
+		}
+		return 0, ""
+	}
+	port := 1024
+	routes := []Route{
+		{Protocol: "http", URL: "app.example.com"},
+		{Protocol: "tcp", Port: &port, URL: "tcp.example.com:1024"},
+		{Protocol: "http", URL: "app.apps.internal"},
+		{Protocol: "http", URL: "app.example.com/api"},
+	}
+	routes[0].Relationships.Domain.Data.GUID = "domain-guid"
+	routes[2].Relationships.Domain.Data.GUID = "internal-domain-guid"
+	routes[3].Relationships.Domain.Data.GUID = "domain-guid"
+
+	urls, err := testRepo(t, cf).ProbeURLs(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://app.example.com", "https://app.example.com/api"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("ProbeURLs() = %v, want %v", urls, want)
+	}
+}
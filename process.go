@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HealthCheck struct {
+	Type string `json:"type"`
+	Data struct {
+		Timeout           *int   `json:"timeout,omitempty"`
+		InvocationTimeout *int   `json:"invocation_timeout,omitempty"`
+		Endpoint          string `json:"endpoint,omitempty"`
+	} `json:"data"`
+}
+
+type Process struct {
+	GUID        string      `json:"guid"`
+	Type        string      `json:"type"`
+	Command     string      `json:"command"`
+	Instances   int         `json:"instances"`
+	MemoryInMB  int         `json:"memory_in_mb"`
+	DiskInMB    int         `json:"disk_in_mb"`
+	HealthCheck HealthCheck `json:"health_check"`
+}
+
+func (repo *ApplicationRepo) GetProcess(appGuid, processType string) (Process, error) {
+	var process Process
+	err := repo.curl(&process, fmt.Sprintf("/v3/apps/%s/processes/%s", url.PathEscape(appGuid), url.PathEscape(processType)))
+	return process, err
+}
+
+func (repo *ApplicationRepo) GetProcesses(appGuid string) ([]Process, error) {
+	var processes []Process
+	err := repo.curlAll(&processes, fmt.Sprintf("/v3/apps/%s/processes?per_page=5000", url.PathEscape(appGuid)))
+	return processes, err
+}
+
+// ScaleProcesses gives each process of the app the memory and disk in MB of
+// the source process of the same type, and its number of instances unless
+// matchInstances is false. Only what differs from the current scaling of a
+// process is passed, as changing the memory or disk restarts it.
+func (repo *ApplicationRepo) ScaleProcesses(appName, appGuid string, sources []Process, matchInstances bool) error {
+	processes, err := repo.GetProcesses(appGuid)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		for _, process := range processes {
+			if process.Type != source.Type {
+				continue
+			}
+			args := []string{"scale", appName, "--process", process.Type}
+			if matchInstances && source.Instances != process.Instances {
+				args = append(args, "-i", strconv.Itoa(source.Instances))
+			}
+			if source.MemoryInMB != process.MemoryInMB {
+				args = append(args, "-m", fmt.Sprintf("%dM", source.MemoryInMB))
+			}
+			if source.DiskInMB != process.DiskInMB {
+				args = append(args, "-k", fmt.Sprintf("%dM", source.DiskInMB))
+			}
+			if len(args) == 4 {
+				continue
+			}
+			_, err = repo.conn.CliCommand(append(args, "-f")...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (repo *ApplicationRepo) UpdateProcessHealthCheck(processGuid string, healthCheck HealthCheck) error {
+	body := map[string]interface{}{"health_check": healthCheck}
+	return repo.curlWithBody(nil, "PATCH", fmt.Sprintf("/v3/processes/%s", url.PathEscape(processGuid)), body)
+}
+
+// CopyHealthChecks gives each process of the app the health check of the
+// process of the same type of the source app: the push from the generated
+// manifest may reset the HTTP endpoint or the timeouts, and a wrong health
+// check makes the new app look unhealthy.
+func (repo *ApplicationRepo) CopyHealthChecks(sourceAppGuid, appGuid string) error {
+	sources, err := repo.GetProcesses(sourceAppGuid)
+	if err != nil {
+		return err
+	}
+	targets, err := repo.GetProcesses(appGuid)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		for _, target := range targets {
+			if target.Type != source.Type || reflect.DeepEqual(target.HealthCheck, source.HealthCheck) {
+				continue
+			}
+			repo.printf("copying %s health check of %s process\n", source.HealthCheck.Type, source.Type)
+			err := repo.UpdateProcessHealthCheck(target.GUID, source.HealthCheck)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var healthCheckTypes = []string{"http", "port", "process"}
+
+func isHealthCheckType(healthCheckType string) bool {
+	for _, t := range healthCheckTypes {
+		if t == healthCheckType {
+			return true
+		}
+	}
+	return false
+}
+
+// SetHealthCheckType sets the health check type of the web process of the
+// app.
+func (repo *ApplicationRepo) SetHealthCheckType(appName, healthCheckType string) error {
+	_, err := repo.conn.CliCommand("set-health-check", appName, healthCheckType)
+	return err
+}
+
+// RestoreHealthCheckType gives the web process of the app the health check
+// type and endpoint of the web process of the source app, keeping its
+// timeouts. It applies to the instances started afterwards.
+func (repo *ApplicationRepo) RestoreHealthCheckType(sourceAppGuid, appGuid string) error {
+	source, err := repo.GetProcess(sourceAppGuid, "web")
+	if err != nil {
+		return err
+	}
+	web, err := repo.GetProcess(appGuid, "web")
+	if err != nil {
+		return err
+	}
+	healthCheck := web.HealthCheck
+	healthCheck.Type = source.HealthCheck.Type
+	healthCheck.Data.Endpoint = source.HealthCheck.Data.Endpoint
+	if reflect.DeepEqual(healthCheck, web.HealthCheck) {
+		return nil
+	}
+	repo.printf("restoring %s health check of web process\n", healthCheck.Type)
+	return repo.UpdateProcessHealthCheck(web.GUID, healthCheck)
+}
+
+// SetProcessCommand sets the start command of the process of the given type
+// of the app.
+func (repo *ApplicationRepo) SetProcessCommand(appGuid, processType, command string) error {
+	process, err := repo.GetProcess(appGuid, processType)
+	if err != nil || process.Command == command {
+		return err
+	}
+	repo.printf("setting start command of %s process\n", processType)
+	body := map[string]interface{}{"command": command}
+	return repo.curlWithBody(nil, "PATCH", fmt.Sprintf("/v3/processes/%s", url.PathEscape(process.GUID)), body)
+}
+
+// CopyCommands gives each process of the app the start command of the
+// process of the same type of the source app.
+func (repo *ApplicationRepo) CopyCommands(sourceAppGuid, appGuid string) error {
+	sources, err := repo.GetProcesses(sourceAppGuid)
+	if err != nil {
+		return err
+	}
+	targets, err := repo.GetProcesses(appGuid)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		for _, target := range targets {
+			if target.Type != source.Type || source.Command == "" || target.Command == source.Command {
+				continue
+			}
+			repo.printf("copying start command of %s process\n", source.Type)
+			body := map[string]interface{}{"command": source.Command}
+			err := repo.curlWithBody(nil, "PATCH", fmt.Sprintf("/v3/processes/%s", url.PathEscape(target.GUID)), body)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ProcessInstance is the state of an instance of a process, from its stats.
+type ProcessInstance struct {
+	Index int    `json:"index"`
+	State string `json:"state"`
+}
+
+func (repo *ApplicationRepo) GetProcessInstances(appGuid, processType string) ([]ProcessInstance, error) {
+	var stats struct {
+		Resources []ProcessInstance `json:"resources"`
+	}
+	err := repo.curl(&stats, fmt.Sprintf("/v3/apps/%s/processes/%s/stats", url.PathEscape(appGuid), url.PathEscape(processType)))
+	return stats.Resources, err
+}
+
+// WaitForAppRunning polls the instances of every process of the app, such as
+// workers along with web, until they are all running. A restage may succeed
+// while the instances then crash, so it gives up after the timeout with the
+// states the instances were in, or once the context is done.
+func (repo *ApplicationRepo) WaitForAppRunning(ctx context.Context, appName string, timeout time.Duration) error {
+	appGuid, err := repo.GetAppGuid(appName)
+	if err != nil {
+		return err
+	}
+	processes, err := repo.GetProcesses(appGuid)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var notRunning []string
+		for _, process := range processes {
+			if process.Instances == 0 {
+				continue
+			}
+			instances, err := repo.GetProcessInstances(appGuid, process.Type)
+			if err != nil {
+				return err
+			}
+			for _, instance := range instances {
+				if instance.State != "RUNNING" {
+					notRunning = append(notRunning, fmt.Sprintf("%s #%d %s", process.Type, instance.Index, instance.State))
+				}
+			}
+		}
+		if len(notRunning) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("instances of app %s not running after %s: %s", appName, timeout, strings.Join(notRunning, ", "))
+		}
+		err = sleep(ctx, repo.PollInterval)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// FailedToStart tells whether the app failed to start or to pass its health
+// check, as opposed to failing to stage or to reach the Cloud Controller:
+// its latest build staged but instances of its processes aren't running. The
+// errors of the cf commands run through the plugin RPC don't tell which.
+func (repo *ApplicationRepo) FailedToStart(appName string) (bool, error) {
+	appGuid, err := repo.GetAppGuid(appName)
+	if err != nil {
+		return false, err
+	}
+	var builds struct {
+		Resources []Build `json:"resources"`
+	}
+	err = repo.curl(&builds, fmt.Sprintf("/v3/builds?app_guids=%s&order_by=-created_at&per_page=1", url.QueryEscape(appGuid)))
+	if err != nil {
+		return false, err
+	}
+	if len(builds.Resources) == 0 || builds.Resources[0].State != "STAGED" {
+		return false, nil
+	}
+
+	processes, err := repo.GetProcesses(appGuid)
+	if err != nil {
+		return false, err
+	}
+	for _, process := range processes {
+		if process.Instances == 0 {
+			continue
+		}
+		instances, err := repo.GetProcessInstances(appGuid, process.Type)
+		if err != nil {
+			return false, err
+		}
+		for _, instance := range instances {
+			if instance.State != "RUNNING" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+const startRetryDelay = 10 * time.Second
+
+// StartWithRetries runs start, which restarts, restages or waits for the app,
+// and when its instances failed to start, as told by FailedToStart, restarts
+// it up to retries times, waiting startRetryDelay in between, then waits for
+// its instances to be running for at most timeout: an app may fail its first
+// start because of a slow dependency. A restart is enough, the app being
+// staged by then. The retries end once the context is done.
+func (repo *ApplicationRepo) StartWithRetries(ctx context.Context, appName string, retries int, timeout time.Duration, start func(string) error) error {
+	err := start(appName)
+	for retry := 1; err != nil && retry <= retries; retry++ {
+		failed, checkErr := repo.FailedToStart(appName)
+		if checkErr != nil || !failed {
+			return err
+		}
+		repo.printf("warning: app %s failed to start: %s, restarting it in %s (retry %d/%d)\n", appName, err, startRetryDelay, retry, retries)
+		if sleep(ctx, startRetryDelay) != nil {
+			return err
+		}
+		err = repo.RestartApplication(appName)
+		if err == nil {
+			err = repo.WaitForAppRunning(ctx, appName, timeout)
+		}
+	}
+	return err
+}
+
+// SetStartTimeout sets the time the instances of the web process of the app
+// have to pass their health check when starting.
+func (repo *ApplicationRepo) SetStartTimeout(appGuid string, timeout time.Duration) error {
+	web, err := repo.GetProcess(appGuid, "web")
+	if err != nil {
+		return err
+	}
+	seconds := int(timeout.Seconds())
+	healthCheck := web.HealthCheck
+	healthCheck.Data.Timeout = &seconds
+	return repo.UpdateProcessHealthCheck(web.GUID, healthCheck)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+)
+
+// canPrompt tells whether the user can be asked questions, which isn't the
+// case when stdin isn't a terminal, e.g. in pipelines.
+func canPrompt() bool {
+	return isatty.IsTerminal(os.Stdin.Fd())
+}
+
+// stdoutIsTerminal tells whether the output can be rewritten in place.
+func stdoutIsTerminal() bool {
+	return isatty.IsTerminal(os.Stdout.Fd())
+}
+
+var spinnerFrames = []rune(`|/-\`)
+
+// spinner shows an operation is going on by rewriting the same line.
+type spinner struct {
+	frame int
+}
+
+func (s *spinner) Show(message string) {
+	fmt.Printf("\r\033[K%c %s", spinnerFrames[s.frame%len(spinnerFrames)], message)
+	s.frame++
+}
+
+// Clear erases the line of the spinner.
+func (s *spinner) Clear() {
+	fmt.Print("\r\033[K")
+}
+
+// confirm asks a yes or no question, no being the default answer.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"code.cloudfoundry.org/cli/plugin"
+)
+
+// restoreSnapshot gives the app the stack, environment variables, services,
+// routes and scale recorded in the snapshot, e.g. to revert its configuration
+// after a stack change it misbehaves with. Services, routes and environment
+// variables the app has on top of the snapshot are left alone, except that
+// environment variables are given their recorded values. The app is restaged
+// when its stack, environment or services changed.
+func restoreSnapshot(ctx context.Context, cliConnection plugin.CliConnection, appName string, snapshot Snapshot) error {
+	appRepo, err := NewApplicationRepo(cliConnection)
+	if err != nil {
+		return err
+	}
+	defer appRepo.DeleteDir()
+
+	if snapshot.AppName != appName {
+		fmt.Printf("warning: the snapshot is of app %s, restoring it onto app %s\n", snapshot.AppName, appName)
+	}
+	appGuid, err := appRepo.GetAppGuid(appName)
+	if err != nil {
+		return err
+	}
+	app, err := appRepo.GetApp(appGuid)
+	if err != nil {
+		return err
+	}
+	if app.Lifecycle.Type != snapshot.Lifecycle {
+		return fmt.Errorf("app %s has lifecycle %s, the snapshot has lifecycle %s", appName, app.Lifecycle.Type, snapshot.Lifecycle)
+	}
+
+	restage := false
+	if snapshot.Stack != "" && app.Lifecycle.Data.Stack != snapshot.Stack {
+		fmt.Printf("moving app %s from stack %s back to stack %s\n", appName, app.Lifecycle.Data.Stack, snapshot.Stack)
+		err = appRepo.AssignTargetStack(ctx, appGuid, snapshot.Stack)
+		if err != nil {
+			return err
+		}
+		restage = true
+	}
+
+	changed, err := appRepo.RestoreEnv(appGuid, snapshot.Env)
+	if err != nil {
+		return err
+	}
+	restage = restage || changed
+
+	services, err := appRepo.GetBoundServices(appGuid)
+	if err != nil {
+		return err
+	}
+	bound := map[string]bool{}
+	for _, service := range services {
+		bound[service] = true
+	}
+	for _, service := range snapshot.Services {
+		if bound[service] {
+			continue
+		}
+		_, err := appRepo.conn.CliCommand("bind-service", appName, service)
+		if err != nil {
+			return err
+		}
+		restage = true
+	}
+
+	err = appRepo.RestoreRoutes(appGuid, snapshot.Routes)
+	if err != nil {
+		return err
+	}
+	err = appRepo.ScaleProcesses(appName, appGuid, snapshot.Processes, true)
+	if err != nil {
+		return err
+	}
+
+	if !restage {
+		return nil
+	}
+	return appRepo.RestageApplication(appName)
+}
+
+// RestoreEnv gives the user-provided environment variables of the app the
+// given values, and tells whether any of them changed.
+func (repo *ApplicationRepo) RestoreEnv(appGuid string, env map[string]string) (bool, error) {
+	current, err := repo.GetAppEnv(appGuid)
+	if err != nil {
+		return false, err
+	}
+
+	changed := map[string]string{}
+	for name, value := range env {
+		if isSystemEnvVar(name) {
+			continue
+		}
+		if currentValue, ok := current[name]; !ok || currentValue != value {
+			changed[name] = value
+		}
+	}
+	if len(changed) == 0 {
+		return false, nil
+	}
+	repo.printf("restoring %d environment variable(s)\n", len(changed))
+	body := map[string]interface{}{"var": changed}
+	return true, repo.curlWithBody(nil, "PATCH", fmt.Sprintf("/v3/apps/%s/environment_variables", url.PathEscape(appGuid)), body)
+}
+
+// RestoreRoutes maps to the app the routes of the current space with the given
+// URLs which it isn't mapped to, warning about those which no longer exist.
+func (repo *ApplicationRepo) RestoreRoutes(appGuid string, urls []string) error {
+	routes, err := repo.GetAppRoutes(appGuid)
+	if err != nil {
+		return err
+	}
+	mapped := map[string]bool{}
+	for _, route := range routes {
+		mapped[route.URL] = true
+	}
+	var missing []string
+	for _, routeURL := range urls {
+		if !mapped[routeURL] {
+			missing = append(missing, routeURL)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	space, err := repo.conn.GetCurrentSpace()
+	if err != nil {
+		return err
+	}
+	var spaceRoutes []Route
+	err = repo.curlAll(&spaceRoutes, fmt.Sprintf("/v3/routes?space_guids=%s&per_page=5000", url.QueryEscape(space.Guid)))
+	if err != nil {
+		return err
+	}
+	byURL := map[string]Route{}
+	for _, route := range spaceRoutes {
+		byURL[route.URL] = route
+	}
+	sort.Strings(missing)
+	for _, routeURL := range missing {
+		route, ok := byURL[routeURL]
+		if !ok {
+			repo.printf("warning: route %s no longer exists in the space, it can't be mapped\n", routeURL)
+			continue
+		}
+		err := repo.MapRoute(route, appGuid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
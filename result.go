@@ -0,0 +1,33 @@
+package main
+
+import "time"
+
+// Result describes the new app once its stack was changed, for automation
+// chaining further steps.
+type Result struct {
+	AppName   string    `json:"app_name"`
+	AppGUID   string    `json:"app_guid"`
+	Stack     string    `json:"stack"`
+	Routes    []string  `json:"routes"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// writeResult writes the result of the stack change of the app to the file.
+func writeResult(appRepo *ApplicationRepo, appName, stackName, path string) error {
+	appGuid, err := appRepo.GetAppGuid(appName)
+	if err != nil {
+		return err
+	}
+	routes, err := appRepo.GetAppRoutes(appGuid)
+	if err != nil {
+		return err
+	}
+	result := Result{
+		AppName:   appName,
+		AppGUID:   appGuid,
+		Stack:     stackName,
+		Routes:    routeURLs(routes),
+		ChangedAt: time.Now(),
+	}
+	return writeFileAtomically(path, result)
+}
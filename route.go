@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Route is a route of any kind: HTTP routes with or without a host, which may
+// be a wildcard, and a path, or TCP routes with a port. Routes are mapped by
+// GUID, whatever their kind.
+type Route struct {
+	GUID     string `json:"guid"`
+	Protocol string `json:"protocol"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Port     *int   `json:"port"`
+	URL      string `json:"url"`
+
+	Relationships struct {
+		Domain relationship `json:"domain"`
+	} `json:"relationships"`
+}
+
+// Domain is a domain of routes. Internal domains are only reachable by apps
+// over the container network.
+type Domain struct {
+	GUID     string `json:"guid"`
+	Internal bool   `json:"internal"`
+}
+
+// ProbeURLs returns the HTTPS URLs of the routes which can be probed from
+// outside the foundation, leaving out TCP routes and routes on internal
+// domains.
+func (repo *ApplicationRepo) ProbeURLs(routes []Route) ([]string, error) {
+	internal := map[string]bool{}
+	var urls []string
+	for _, route := range routes {
+		if route.Protocol == "tcp" || route.Port != nil {
+			continue
+		}
+		domainGuid := route.Relationships.Domain.Data.GUID
+		isInternal, ok := internal[domainGuid]
+		if !ok && domainGuid != "" {
+			var domain Domain
+			err := repo.curl(&domain, "/v3/domains/"+url.PathEscape(domainGuid))
+			if err != nil {
+				return nil, err
+			}
+			isInternal = domain.Internal
+			internal[domainGuid] = isInternal
+		}
+		if !isInternal {
+			urls = append(urls, "https://"+route.URL)
+		}
+	}
+	return urls, nil
+}
+
+// GetAppRoutes returns the routes mapped to the app.
+func (repo *ApplicationRepo) GetAppRoutes(appGuid string) ([]Route, error) {
+	var routes []Route
+	err := repo.curlAll(&routes, fmt.Sprintf("/v3/apps/%s/routes?per_page=5000", url.PathEscape(appGuid)))
+	return routes, err
+}
+
+// RouteBinding is the binding of a route to a route service, which sees the
+// requests to the route before the apps it is mapped to.
+type RouteBinding struct {
+	RouteGUID           string
+	ServiceInstanceGUID string
+}
+
+type relationship struct {
+	Data struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+// GetRouteBindings returns the route service bindings of the routes.
+func (repo *ApplicationRepo) GetRouteBindings(routes []Route) ([]RouteBinding, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	guids := make([]string, 0, len(routes))
+	for _, route := range routes {
+		guids = append(guids, url.QueryEscape(route.GUID))
+	}
+	var resources []struct {
+		Relationships struct {
+			Route           relationship `json:"route"`
+			ServiceInstance relationship `json:"service_instance"`
+		} `json:"relationships"`
+	}
+	err := repo.curlAll(&resources, fmt.Sprintf("/v3/service_route_bindings?route_guids=%s&per_page=5000", strings.Join(guids, ",")))
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := make([]RouteBinding, 0, len(resources))
+	for _, resource := range resources {
+		bindings = append(bindings, RouteBinding{
+			RouteGUID:           resource.Relationships.Route.Data.GUID,
+			ServiceInstanceGUID: resource.Relationships.ServiceInstance.Data.GUID,
+		})
+	}
+	return bindings, nil
+}
+
+// BindRouteService binds the route to the route service, waiting for the
+// binding to complete when the broker creates it asynchronously.
+func (repo *ApplicationRepo) BindRouteService(ctx context.Context, binding RouteBinding) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"relationships": map[string]interface{}{
+			"route":            map[string]interface{}{"data": map[string]string{"guid": binding.RouteGUID}},
+			"service_instance": map[string]interface{}{"data": map[string]string{"guid": binding.ServiceInstanceGUID}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	response, err := repo.curlRaw("-X", "POST", "/v3/service_route_bindings", "-d", string(body))
+	if err != nil {
+		return err
+	}
+	err = responseError(response.Body)
+	if err != nil {
+		return err
+	}
+
+	location := response.Header["location"]
+	if !strings.Contains(location, "/v3/jobs/") {
+		return nil
+	}
+	return repo.WaitForJob(ctx, path.Base(location), repo.PollTimeout, repo.PollInterval)
+}
+
+// RestoreRouteBindings binds again the routes of the bindings which are no
+// longer bound to their route service, and returns how many it bound.
+func (repo *ApplicationRepo) RestoreRouteBindings(ctx context.Context, bindings []RouteBinding) (int, error) {
+	routes := make([]Route, 0, len(bindings))
+	for _, binding := range bindings {
+		routes = append(routes, Route{GUID: binding.RouteGUID})
+	}
+	current, err := repo.GetRouteBindings(routes)
+	if err != nil {
+		return 0, err
+	}
+
+	bound := map[RouteBinding]bool{}
+	for _, binding := range current {
+		bound[binding] = true
+	}
+	restored := 0
+	for _, binding := range bindings {
+		if bound[binding] {
+			continue
+		}
+		err := repo.BindRouteService(ctx, binding)
+		if err != nil {
+			return restored, err
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// GetRoutesWithServices returns the URLs of the routes bound to a route
+// service.
+func (repo *ApplicationRepo) GetRoutesWithServices(routes []Route) ([]string, error) {
+	bindings, err := repo.GetRouteBindings(routes)
+	if err != nil {
+		return nil, err
+	}
+
+	bound := map[string]bool{}
+	for _, binding := range bindings {
+		bound[binding.RouteGUID] = true
+	}
+	var urls []string
+	for _, route := range routes {
+		if bound[route.GUID] {
+			urls = append(urls, route.URL)
+		}
+	}
+	return urls, nil
+}
+
+func routeURLs(routes []Route) []string {
+	urls := make([]string, 0, len(routes))
+	for _, route := range routes {
+		urls = append(urls, route.URL)
+	}
+	return urls
+}
+
+func (repo *ApplicationRepo) MapRoute(route Route, appGuid string) error {
+	body := map[string]interface{}{
+		"destinations": []interface{}{
+			map[string]interface{}{
+				"app": map[string]string{"guid": appGuid},
+			},
+		},
+	}
+	return repo.curlWithBody(nil, "POST", fmt.Sprintf("/v3/routes/%s/destinations", url.PathEscape(route.GUID)), body)
+}
+
+// UnmapRoute removes the destinations of the route which are the app.
+func (repo *ApplicationRepo) UnmapRoute(route Route, appGuid string) error {
+	var destinations struct {
+		Destinations []struct {
+			GUID string `json:"guid"`
+			App  struct {
+				GUID string `json:"guid"`
+			} `json:"app"`
+		} `json:"destinations"`
+	}
+	err := repo.curl(&destinations, fmt.Sprintf("/v3/routes/%s/destinations", url.PathEscape(route.GUID)))
+	if err != nil {
+		return err
+	}
+	for _, destination := range destinations.Destinations {
+		if destination.App.GUID != appGuid {
+			continue
+		}
+		err := repo.curl(nil, "-X", "DELETE", fmt.Sprintf("/v3/routes/%s/destinations/%s", url.PathEscape(route.GUID), url.PathEscape(destination.GUID)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyRoutes maps to the app the routes of the source app it isn't mapped to
+// yet, and returns those it mapped, even when failing to map one of them.
+func (repo *ApplicationRepo) CopyRoutes(sourceAppGuid, appGuid string) ([]Route, error) {
+	sourceRoutes, err := repo.GetAppRoutes(sourceAppGuid)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := repo.GetAppRoutes(appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	mapped := map[string]bool{}
+	for _, route := range routes {
+		mapped[route.GUID] = true
+	}
+	var newlyMapped []Route
+	for _, route := range sourceRoutes {
+		if mapped[route.GUID] {
+			continue
+		}
+		repo.printf("mapping route %s\n", route.URL)
+		err := repo.MapRoute(route, appGuid)
+		if err != nil {
+			return newlyMapped, err
+		}
+		newlyMapped = append(newlyMapped, route)
+	}
+	return newlyMapped, nil
+}
+
+// UnmapRoutes unmaps the routes from the app, and returns those it unmapped,
+// even when failing to unmap one of them.
+func (repo *ApplicationRepo) UnmapRoutes(routes []Route, appGuid string) ([]Route, error) {
+	var unmapped []Route
+	for _, route := range routes {
+		err := repo.UnmapRoute(route, appGuid)
+		if err != nil {
+			return unmapped, err
+		}
+		unmapped = append(unmapped, route)
+	}
+	return unmapped, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runSmokeTest runs the command with a shell, giving it the name and the
+// comma separated route URLs of the app in APP_NAME and APP_ROUTES. Its
+// output is printed to out when it fails.
+func runSmokeTest(ctx context.Context, out io.Writer, command, appName string, routes []string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), "APP_NAME="+appName, "APP_ROUTES="+strings.Join(routes, ","))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(out, "smoke test output:\n%s\n", output)
+		return fmt.Errorf("smoke test failed: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const snapshotVersion = 1
+
+// Snapshot records the configuration of an app before its stack is changed.
+type Snapshot struct {
+	Version    int       `json:"version"`
+	CapturedAt time.Time `json:"captured_at"`
+	AppName    string    `json:"app_name"`
+	AppGUID    string    `json:"app_guid"`
+	// Lifecycle is the lifecycle type of the app: buildpack, docker or cnb.
+	Lifecycle  string            `json:"lifecycle"`
+	Stack      string            `json:"stack"`
+	Buildpacks []string          `json:"buildpacks"`
+	Env        map[string]string `json:"env"`
+	Services   []string          `json:"services"`
+	Routes     []string          `json:"routes"`
+	// RouteServices are the URLs of the routes of the app bound to a route
+	// service.
+	RouteServices []string    `json:"route_services"`
+	Processes     []Process   `json:"processes"`
+	Metadata      AppMetadata `json:"metadata"`
+}
+
+// CaptureSnapshot records the configuration of the app.
+func (repo *ApplicationRepo) CaptureSnapshot(appGuid string) (Snapshot, error) {
+	snapshot := Snapshot{Version: snapshotVersion, CapturedAt: time.Now()}
+	app, err := repo.GetApp(appGuid)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.AppName, snapshot.AppGUID = app.Name, app.GUID
+	snapshot.Lifecycle = app.Lifecycle.Type
+	snapshot.Stack, snapshot.Buildpacks = app.Lifecycle.Data.Stack, app.Lifecycle.Data.Buildpacks
+
+	snapshot.Env, err = repo.GetAppEnv(appGuid)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Services, err = repo.GetBoundServices(appGuid)
+	if err != nil {
+		return snapshot, err
+	}
+	routes, err := repo.GetAppRoutes(appGuid)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Routes = routeURLs(routes)
+	snapshot.RouteServices, err = repo.GetRoutesWithServices(routes)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Processes, err = repo.GetProcesses(appGuid)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Metadata, err = repo.GetAppMetadata(appGuid)
+	return snapshot, err
+}
+
+// appFilePath returns the path a file about the app, such as its snapshot, is
+// written to: the given path, with {app} replaced by the name of the app so
+// that changing the stack of several apps doesn't write them all to the same
+// file.
+func appFilePath(path, appName string) string {
+	return strings.Replace(path, "{app}", appName, -1)
+}
+
+// Write writes the snapshot to the file, replacing it if it exists.
+func (snapshot Snapshot) Write(path string) error {
+	return writeFileAtomically(path, snapshot)
+}
+
+func ReadSnapshot(path string) (Snapshot, error) {
+	var snapshot Snapshot
+	f, err := os.Open(path)
+	if err != nil {
+		return snapshot, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&snapshot)
+	if err != nil {
+		return snapshot, fmt.Errorf("invalid snapshot %s: %s", path, err)
+	}
+	return snapshot, nil
+}
+
+// Validate returns the problems preventing the stack of the app described by
+// the snapshot from being changed: missing data, and configuration the
+// migration or a restore of the snapshot can't reproduce.
+func (snapshot Snapshot) Validate() []string {
+	var problems []string
+	if snapshot.Version != snapshotVersion {
+		problems = append(problems, fmt.Sprintf("unsupported snapshot version %d, expected %d", snapshot.Version, snapshotVersion))
+	}
+	if snapshot.AppName == "" {
+		problems = append(problems, "missing app_name")
+	}
+	if snapshot.AppGUID == "" {
+		problems = append(problems, "missing app_guid")
+	}
+	if snapshot.Lifecycle == "" {
+		problems = append(problems, "missing lifecycle")
+	}
+	if snapshot.Lifecycle != "" && snapshot.Lifecycle != "buildpack" {
+		problems = append(problems, fmt.Sprintf("unsupported lifecycle '%s', only buildpack apps have a stack to change", snapshot.Lifecycle))
+	}
+	if snapshot.Lifecycle == "buildpack" && snapshot.Stack == "" {
+		problems = append(problems, "missing stack")
+	}
+	if !snapshot.hasProcess("web") {
+		problems = append(problems, "missing web process")
+	}
+	// The migration keeps the routes bound, but the snapshot doesn't tell
+	// to which route service, so restoring it can't bind them again.
+	for _, route := range snapshot.RouteServices {
+		problems = append(problems, fmt.Sprintf("route %s is bound to a route service, which restoring the snapshot doesn't bind it to again", route))
+	}
+	return problems
+}
+
+func (snapshot Snapshot) hasProcess(processType string) bool {
+	for _, process := range snapshot.Processes {
+		if process.Type == processType {
+			return true
+		}
+	}
+	return false
+}
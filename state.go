@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin"
+)
+
+// MigrationState is a milestone of the stack change of an app, persisted so
+// an interrupted change can be resumed or rolled back.
+type MigrationState string
+
+// The states in the order they are reached.
+const (
+	StateCaptured MigrationState = "CAPTURED"
+	StateRenamed  MigrationState = "RENAMED"
+	StatePushed   MigrationState = "PUSHED"
+	// StateCopied is reached once the bits were copied to the new app, and
+	// again once it was configured and started on the old stack.
+	StateCopied   MigrationState = "COPIED"
+	StateAssigned MigrationState = "ASSIGNED"
+	StateRestaged MigrationState = "RESTAGED"
+	// StateSwapped is reached once the instances of the new app run on the
+	// new stack, serving the routes of the app alongside the old one.
+	StateSwapped MigrationState = "SWAPPED"
+	StateCleaned MigrationState = "CLEANED"
+)
+
+// StateFile records how far the stack change of an app went.
+type StateFile struct {
+	AppName       string         `json:"app_name"`
+	VenerableName string         `json:"venerable_name"`
+	Stack         string         `json:"stack"`
+	OldStack      string         `json:"old_stack"`
+	OldAppGUID    string         `json:"old_app_guid"`
+	State         MigrationState `json:"state"`
+	Step          string         `json:"step"`
+	Manifest      string         `json:"manifest"`
+	// BoundServices and MappedRoutes are the services bound and routes
+	// mapped to the new app, to release them when rolling back. They are
+	// saved along with the next state reached.
+	BoundServices []string `json:"bound_services,omitempty"`
+	MappedRoutes  []Route  `json:"mapped_routes,omitempty"`
+	// UpdatedAt is when the state was last reached.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// stateFilePath returns the path of the state file of the app in the
+// current space.
+func (repo *ApplicationRepo) stateFilePath(appName string) (string, error) {
+	space, err := repo.conn.GetCurrentSpace()
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s_%s.json", space.Guid, url.PathEscape(appName))
+	return filepath.Join(dir, "cf-bg-change-stack", "state", name), nil
+}
+
+// LoadStateFile returns the state file at path, or nil if there is none.
+func LoadStateFile(path string) (*StateFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state StateFile
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %s", path, err)
+	}
+	if state.VenerableName == "" {
+		// Saved before the suffix could be changed.
+		state.VenerableName = venerableAppName(state.AppName, defaultVenerableSuffix)
+	}
+	return &state, nil
+}
+
+func (state StateFile) Save(path string) error {
+	return writeFileAtomically(path, state)
+}
+
+// rollbackInterrupted reverts the interrupted stack change of an app,
+// restoring the old app under its name.
+func rollbackInterrupted(appRepo *ApplicationRepo, appName string, state StateFile) error {
+	if state.State == StateCaptured {
+		appRepo.printf("app %s wasn't modified, nothing to roll back\n", appName)
+		return nil
+	}
+	if state.State == StateCleaned {
+		return fmt.Errorf("app %s was already deleted, it can't be restored", state.VenerableName)
+	}
+	// Without the old app, the app may be the old one which was never
+	// renamed, whose services and routes must be left alone.
+	exists, err := appRepo.DoesAppExist(state.VenerableName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		releaseNewApp(appRepo, appName, state)
+	}
+	return restoreVenerableApp(appRepo, appName, state.VenerableName)
+}
+
+// releaseNewApp unbinds the services bound and unmaps the routes mapped to the
+// new app by the stack change, so they stop reaching it even if it can't be
+// deleted. Failures are only warned about, deleting the app releases them
+// too.
+func releaseNewApp(appRepo *ApplicationRepo, appName string, state StateFile) {
+	if len(state.BoundServices) > 0 {
+		err := appRepo.UnbindServices(appName, state.BoundServices)
+		if err != nil {
+			appRepo.printf("warning: failed to unbind services from app %s: %s\n", appName, err)
+		}
+	}
+	if len(state.MappedRoutes) > 0 {
+		newAppGuid, err := appRepo.GetAppGuid(appName)
+		if err == nil {
+			_, err = appRepo.UnmapRoutes(state.MappedRoutes, newAppGuid)
+		}
+		if err != nil {
+			appRepo.printf("warning: failed to unmap routes from app %s: %s\n", appName, err)
+		}
+	}
+}
+
+// restoreVenerableApp deletes the app, if any, and gives its name back to the
+// venerable app. Without a venerable app, the app may be the old one which was
+// never renamed, so it is left alone.
+func restoreVenerableApp(appRepo *ApplicationRepo, appName, venerableName string) error {
+	exists, err := appRepo.DoesAppExist(venerableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no app %s to restore, app %s is left alone as it may be the old app", venerableName, appName)
+	}
+	exists, err = appRepo.DoesAppExist(appName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		err = appRepo.DeleteApplication(appName)
+		if err != nil {
+			return err
+		}
+	}
+	return appRepo.RenameApplication(venerableName, appName)
+}
+
+// rollbackChangeStack reverts a stack change which died without rolling back,
+// whether or not its state was saved.
+func rollbackChangeStack(cliConnection plugin.CliConnection, appName, venerableSuffix string) error {
+	appRepo, err := NewApplicationRepo(cliConnection)
+	if err != nil {
+		return err
+	}
+	defer appRepo.DeleteDir()
+
+	statePath, err := appRepo.stateFilePath(appName)
+	if err != nil {
+		return err
+	}
+	state, err := LoadStateFile(statePath)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		err = rollbackInterrupted(appRepo, appName, *state)
+		if err != nil {
+			return err
+		}
+		return os.Remove(statePath)
+	}
+
+	venerableName := venerableAppName(appName, venerableSuffix)
+	exists, err := appRepo.DoesAppExist(venerableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("app '%s' not found in current space, there is nothing to roll back", venerableName)
+	}
+	return restoreVenerableApp(appRepo, appName, venerableName)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// saveState saves the state of an interrupted stack change of the app, to be
+// resumed or rolled back.
+func saveState(t *testing.T, cf *fakeCF, state StateFile) string {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	path, err := testRepo(t, cf).stateFilePath(state.AppName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.VenerableName, state.Stack = "app-venerable", "cflinuxfs4"
+	state.Manifest = "applications:\n- name: app\n  memory: 256M\n"
+	err = state.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestResumeFromEachState(t *testing.T) {
+	tests := []struct {
+		state MigrationState
+		step  string
+		// renamed tells whether the old app was renamed, pushed whether
+		// the new app exists.
+		renamed, pushed bool
+	}{
+		{StateCaptured, "check_manifest", false, false},
+		{StateRenamed, "rename", true, false},
+		{StatePushed, "push", true, true},
+		{StateCopied, "copy_bits", true, true},
+		{StateCopied, "restart", true, true},
+		{StateAssigned, "change_stack", true, true},
+		{StateRestaged, "restage", true, true},
+		{StateSwapped, "wait_running", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.step, func(t *testing.T) {
+			cf := newFakeCF()
+			if test.renamed {
+				cf.create("app-venerable")
+			}
+			if test.pushed || !test.renamed {
+				cf.create("app")
+			}
+			path := saveState(t, cf, StateFile{AppName: "app", State: test.state, Step: test.step})
+
+			err := changeStack(context.Background(), cf, "app", "cflinuxfs4", testOptions(t, "--resume", "--no-telemetry"), ioutil.Discard)
+			if err != nil {
+				t.Fatalf("resuming from state %s failed: %s", test.state, err)
+			}
+			if _, ok := cf.apps["app-venerable"]; ok {
+				t.Error("app-venerable is left after the stack change")
+			}
+			if _, ok := cf.apps["app"]; !ok {
+				t.Error("app is gone after the stack change")
+			}
+			if test.pushed && cf.count("push") > 0 {
+				t.Error("app was pushed again")
+			}
+			if test.renamed && cf.ran("rename", "app", "app-venerable") {
+				t.Error("app was renamed again")
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("the state file is left after the stack change: %v", err)
+			}
+		})
+	}
+}
+
+func TestRollbackAfterResumeReleasesNewApp(t *testing.T) {
+	cf := newFakeCF("app-venerable", "app")
+	oldAppGuid := cf.apps["app-venerable"]
+	cf.fail["restage"] = true
+	route := Route{GUID: "route-guid", URL: "app.example.com"}
+	saveState(t, cf, StateFile{
+		AppName:       "app",
+		State:         StateAssigned,
+		Step:          "change_stack",
+		BoundServices: []string{"db"},
+		MappedRoutes:  []Route{route},
+	})
+
+	err := changeStack(context.Background(), cf, "app", "cflinuxfs4", testOptions(t, "--resume", "--no-telemetry"), ioutil.Discard)
+	if exitCode(err) != exitRolledBack {
+		t.Fatalf("the resumed stack change returned %v, want it rolled back", err)
+	}
+	if !cf.ran("unbind-service", "app", "db") {
+		t.Errorf("service db wasn't unbound from the new app, ran %v", cf.commands)
+	}
+	unmapped := false
+	for _, path := range cf.curlPaths() {
+		unmapped = unmapped || path == "/v3/routes/route-guid/destinations"
+	}
+	if !unmapped {
+		t.Errorf("route %s wasn't unmapped from the new app, requested %v", route.URL, cf.curlPaths())
+	}
+	if cf.apps["app"] != oldAppGuid {
+		t.Errorf("app is %s, want the old app %s", cf.apps["app"], oldAppGuid)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// noTelemetryEnv disables the usage counter when set to any value.
+const noTelemetryEnv = "BG_CHANGE_STACK_NO_TELEMETRY"
+
+// UsageStats counts the migrations run by the plugin on this machine. It is
+// only stored locally and never sent anywhere.
+type UsageStats struct {
+	Migrations int       `json:"migrations"`
+	Succeeded  int       `json:"succeeded"`
+	Failed     int       `json:"failed"`
+	LastRun    time.Time `json:"last_run"`
+}
+
+func statsFilePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cf-bg-change-stack", "stats.json"), nil
+}
+
+func telemetryEnabled(options changeStackOptions) bool {
+	return !options.NoTelemetry && os.Getenv(noTelemetryEnv) == ""
+}
+
+func ReadUsageStats() (UsageStats, error) {
+	var stats UsageStats
+	path, err := statsFilePath()
+	if err != nil {
+		return stats, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	err = json.Unmarshal(content, &stats)
+	return stats, err
+}
+
+// statsMutex keeps the migrations run in parallel from losing each other's
+// counts.
+var statsMutex sync.Mutex
+
+// RecordMigration counts a migration which failed if err isn't nil. The stats
+// file is replaced atomically so a concurrent run never reads it half written.
+func RecordMigration(err error) error {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	stats, readErr := ReadUsageStats()
+	if readErr != nil {
+		return readErr
+	}
+	stats.Migrations++
+	if err != nil {
+		stats.Failed++
+	} else {
+		stats.Succeeded++
+	}
+	stats.LastRun = time.Now()
+
+	path, pathErr := statsFilePath()
+	if pathErr != nil {
+		return pathErr
+	}
+	return writeFileAtomically(path, stats)
+}
+
+func writeFileAtomically(path string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"code.cloudfoundry.org/cli/plugin"
+)
+
+// cleanups are run before the plugin exits, including on errors and panics,
+// Run deferring runCleanups.
+var (
+	cleanups      []func()
+	cleanupsMutex sync.Mutex
+)
+
+func atExit(cleanup func()) {
+	cleanupsMutex.Lock()
+	defer cleanupsMutex.Unlock()
+	cleanups = append(cleanups, cleanup)
+}
+
+func runCleanups() {
+	for {
+		cleanupsMutex.Lock()
+		if len(cleanups) == 0 {
+			cleanupsMutex.Unlock()
+			return
+		}
+		cleanup := cleanups[len(cleanups)-1]
+		cleanups = cleanups[:len(cleanups)-1]
+		cleanupsMutex.Unlock()
+		cleanup()
+	}
+}
+
+// exit runs the cleanups and exits with the given status.
+func exit(code int) {
+	runCleanups()
+	os.Exit(code)
+}
+
+// targetOrgAndSpace targets the given org and space, either of which may be
+// empty to keep the current one, and registers the restoration of the
+// current target at exit.
+func targetOrgAndSpace(cliConnection plugin.CliConnection, org, space string) error {
+	if org == "" && space == "" {
+		return nil
+	}
+	currentOrg, err := cliConnection.GetCurrentOrg()
+	if err != nil {
+		return err
+	}
+	currentSpace, err := cliConnection.GetCurrentSpace()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"target"}
+	if org != "" {
+		args = append(args, "-o", org)
+	}
+	if space != "" {
+		args = append(args, "-s", space)
+	}
+	_, err = cliConnection.CliCommandWithoutTerminalOutput(args...)
+	if err != nil {
+		return err
+	}
+
+	atExit(func() {
+		args := []string{"target", "-o", currentOrg.Name}
+		if currentSpace.Name != "" {
+			args = append(args, "-s", currentSpace.Name)
+		}
+		cliConnection.CliCommandWithoutTerminalOutput(args...)
+	})
+	return nil
+}
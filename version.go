@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/cli/plugin"
+)
+
+// Set at link time by bin/build.sh with -ldflags "-X main.version=...".
+var (
+	version   = "1.1.0"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionType parses the version for the plugin metadata, any part which
+// isn't a number being 0.
+func versionType() plugin.VersionType {
+	var parts [3]int
+	for i, part := range strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3) {
+		parts[i], _ = strconv.Atoi(part)
+	}
+	return plugin.VersionType{
+		Major: parts[0],
+		Minor: parts[1],
+		Build: parts[2],
+	}
+}
+
+func versionString() string {
+	return fmt.Sprintf("bg-change-stack version %s (commit %s, built %s)", version, commit, buildDate)
+}